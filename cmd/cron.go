@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
@@ -9,14 +12,17 @@ import (
 	"github.com/robfig/cron/v3"
 
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/notify"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/record"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/shutdown"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/status"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/twitcasting"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/types"
 )
 
 const CronedRecordCmdName = "croned"
 
-func RecordCroned(cfg *config.Config, sinkProvider func(record.RecordContext) (chan<- []byte, string, error)) {
+func RecordCroned(cfg *config.Config, sinkProvider func(record.RecordContext) (chan<- []byte, string, error), notifier *notify.Notifier, coordinator *shutdown.Coordinator, statusServer *status.Server) {
 	log.Printf("Starting in recoding mode [%s] with PID [%d].. \n", CronedRecordCmdName, os.Getpid())
 
 	if len(cfg.Streamers) == 0 {
@@ -29,9 +35,15 @@ func RecordCroned(cfg *config.Config, sinkProvider func(record.RecordContext) (c
 		cron.SkipIfStillRunning(cron.DefaultLogger),
 	))
 
-	interruptCtx, afterGracefulInterrupt := newInterruptableCtx()
+	handleInterrupt(coordinator)
+	interruptCtx := coordinator.Context()
 
-	for _, streamerConfig := range cfg.Streamers {
+	entryIds := make([]cron.EntryID, len(cfg.Streamers))
+	for i, streamerConfig := range cfg.Streamers {
+		encodeProfile, err := cfg.StreamerEncodeProfile(streamerConfig)
+		if err != nil {
+			log.Fatalln("Failed resolving encode profile: ", err)
+		}
 		originalJob := record.ToRecordFunc(&record.RecordConfig{
 			Streamer: streamerConfig.ScreenId,
 			StreamUrlFetcher: func(streamer, cookie string) (*types.StreamInfo, error) {
@@ -40,8 +52,10 @@ func RecordCroned(cfg *config.Config, sinkProvider func(record.RecordContext) (c
 			SinkProvider:   sinkProvider,
 			StreamRecorder: twitcasting.RecordWS,
 			RootContext:    interruptCtx,
-			EncodeOption:   streamerConfig.EncodeOption,
+			EncodeProfile:  encodeProfile,
+			Output:         streamerConfig.Output,
 			AppConfig:      cfg,
+			Notifier:       notifier,
 		})
 
 		wrappedJob := func() {
@@ -52,7 +66,7 @@ func RecordCroned(cfg *config.Config, sinkProvider func(record.RecordContext) (c
 			originalJob()
 		}
 
-		if _, err := c.AddFunc(
+		if entryIds[i], err = c.AddFunc(
 			streamerConfig.Schedule,
 			wrappedJob,
 		); err != nil {
@@ -62,13 +76,59 @@ func RecordCroned(cfg *config.Config, sinkProvider func(record.RecordContext) (c
 		}
 	}
 
+	statusServer.SetScheduler(&cronScheduler{
+		cron:      c,
+		streamers: cfg.Streamers,
+		entryIds:  entryIds,
+		ctx:       interruptCtx,
+	})
+
 	c.Start()
 	log.Println("croned recorder started ")
 
-	// interrupt => stop cron and wait for all task to complete => wait for graceful interrupt
+	// interrupt => stop cron and wait for all task to complete => wait for graceful shutdown
 	<-interruptCtx.Done()
 	<-c.Stop().Done()
-	<-afterGracefulInterrupt
+	<-coordinator.Done()
+
+	log.Println("Terminated on user interrupt")
+}
+
+// cronScheduler lists the scheduled streamers for the status server, and checks them on demand.
+type cronScheduler struct {
+	cron      *cron.Cron
+	streamers []*config.StreamerConfig
+	entryIds  []cron.EntryID
+	ctx       context.Context
+}
+
+func (s *cronScheduler) Streamers() []status.Streamer {
+	streamers := make([]status.Streamer, len(s.streamers))
+	for i, streamerConfig := range s.streamers {
+		streamers[i] = status.Streamer{
+			ScreenID:  streamerConfig.ScreenId,
+			Schedule:  streamerConfig.Schedule,
+			NextCheck: s.cron.Entry(s.entryIds[i]).Next,
+		}
+		if check, ok := twitcasting.LastCheck(streamerConfig.ScreenId); ok {
+			streamers[i].LastCheck, streamers[i].LastResult = check.Time, check.Result
+		}
+	}
+	return streamers
+}
 
-	log.Fatal("Terminated on user interrupt")
+// CheckNow runs the scheduled job of the streamer right away. Like scheduled runs, it is skipped
+// while the previous run of the job is still recording.
+func (s *cronScheduler) CheckNow(screenId string) error {
+	if s.ctx.Err() != nil {
+		return errors.New("the recorder is shutting down")
+	}
+	for i, streamerConfig := range s.streamers {
+		if streamerConfig.ScreenId == screenId {
+			log.Printf("Checking streamer [%s] on demand", screenId)
+			go s.cron.Entry(s.entryIds[i]).WrappedJob.Run()
+			return nil
+		}
+	}
+	return fmt.Errorf("streamer [%s] is not scheduled", screenId)
 }
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/uploader"
+)
+
+const DecryptCmdName = "decrypt"
+
+// Decrypt decrypts downloaded files encrypted before upload, writing each next to it without the .age suffix.
+// It exits non-zero if any file cannot be decrypted.
+func Decrypt(args []string) {
+	decryptCmd := flag.NewFlagSet(DecryptCmdName, flag.ExitOnError)
+	identity := decryptCmd.String("identity", "", "[required] age identity file or SSH private key of a recipient")
+	outputDir := decryptCmd.String("output-dir", "", "[optional] folder for the decrypted files; default next to each file")
+	decryptCmd.Usage = func() {
+		fmt.Fprintf(decryptCmd.Output(), "Usage: %s -identity <key file> [options] <file.age>...\n", DecryptCmdName)
+		decryptCmd.PrintDefaults()
+	}
+	decryptCmd.Parse(args)
+
+	if *identity == "" || decryptCmd.NArg() == 0 {
+		log.Println("Please provide an identity and at least one file")
+		decryptCmd.Usage()
+		os.Exit(1)
+	}
+
+	identities, err := uploader.LoadIdentities(*identity)
+	if err != nil {
+		log.Fatalf("Failed to load identity %s: %v", *identity, err)
+	}
+
+	failed := 0
+	for _, encryptedPath := range decryptCmd.Args() {
+		outputPath := strings.TrimSuffix(encryptedPath, uploader.EncryptedSuffix)
+		if outputPath == encryptedPath {
+			outputPath += ".decrypted"
+		}
+		if *outputDir != "" {
+			outputPath = filepath.Join(*outputDir, filepath.Base(outputPath))
+		}
+		if err := decryptFile(encryptedPath, outputPath, identities); err != nil {
+			log.Printf("FAIL %s: %v", encryptedPath, err)
+			failed++
+		} else {
+			log.Printf("OK   %s -> %s", encryptedPath, outputPath)
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("Decryption failed for %d file(s)", failed)
+		os.Exit(1)
+	}
+}
+
+// decryptFile writes the decrypted file to a temp file first, so that a wrong key or a truncated
+// file never leaves a partial output behind. Existing files are not overwritten.
+func decryptFile(encryptedPath, outputPath string, identities []age.Identity) error {
+	if _, err := os.Stat(outputPath); err == nil {
+		return fmt.Errorf("%s already exists", outputPath)
+	}
+
+	encrypted, err := os.Open(encryptedPath)
+	if err != nil {
+		return err
+	}
+	defer encrypted.Close()
+
+	decrypted, err := uploader.Decrypt(encrypted, identities)
+	if err != nil {
+		return err
+	}
+
+	output, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(output.Name()) // No-op once renamed
+
+	_, err = io.Copy(output, decrypted)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(output.Name(), outputPath)
+}
@@ -4,10 +4,14 @@ import (
 	"flag"
 	"log"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/notify"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/record"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/shutdown"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/sink"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/twitcasting"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/types"
 )
@@ -17,7 +21,7 @@ const (
 	defaultRetryBackoffPeriod = 15 * time.Second
 )
 
-func RecordDirect(cfg *config.Config, args []string, sinkProvider func(record.RecordContext) (chan<- []byte, string, error)) {
+func RecordDirect(cfg *config.Config, args []string, sinkProvider func(record.RecordContext) (chan<- []byte, string, error), notifier *notify.Notifier, coordinator *shutdown.Coordinator) {
 	log.Printf("Starting in recoding mode [%s] with PID [%d].. \n", DirectRecordCmdName, os.Getpid())
 
 	directRecordCmd := flag.NewFlagSet(DirectRecordCmdName, flag.ExitOnError)
@@ -33,6 +37,8 @@ func RecordDirect(cfg *config.Config, args []string, sinkProvider func(record.Re
 		"[optional] retry backoff period",
 	)
 	encodeOption := directRecordCmd.String("encode-option", "", "[optional] encode option of ffmpeg")
+	profileName := directRecordCmd.String("profile", "", "[optional] name of an encode profile in config.yaml")
+	output := directRecordCmd.String("output", sink.OutputMp4, "[optional] converted output: mp4, m4a or both")
 
 	directRecordCmd.Parse(args)
 
@@ -46,8 +52,33 @@ func RecordDirect(cfg *config.Config, args []string, sinkProvider func(record.Re
 		directRecordCmd.Usage()
 		os.Exit(1)
 	}
+	if !slices.Contains([]string{sink.OutputMp4, sink.OutputM4a, sink.OutputBoth}, *output) {
+		log.Printf("output must be one of mp4, m4a or both, got [%s] ", *output)
+		directRecordCmd.Usage()
+		os.Exit(1)
+	}
+
+	if *profileName != "" && *encodeOption != "" {
+		log.Println("profile and encode-option cannot be used together")
+		directRecordCmd.Usage()
+		os.Exit(1)
+	}
+	encodeProfile := config.EncodeProfileFromOption(*encodeOption)
+	if *profileName != "" {
+		var err error
+		encodeProfile, err = cfg.GetEncodeProfile(*profileName)
+		if err == nil {
+			err = encodeProfile.ValidateOutput(*output)
+		}
+		if err != nil {
+			log.Println(err)
+			directRecordCmd.Usage()
+			os.Exit(1)
+		}
+	}
 
-	interruptCtx, afterGracefulInterrupt := newInterruptableCtx()
+	handleInterrupt(coordinator)
+	interruptCtx := coordinator.Context()
 
 	for ; *retries >= 0; *retries-- {
 		log.Printf(
@@ -62,16 +93,21 @@ func RecordDirect(cfg *config.Config, args []string, sinkProvider func(record.Re
 			SinkProvider:   sinkProvider,
 			StreamRecorder: twitcasting.RecordWS,
 			RootContext:    interruptCtx,
-			EncodeOption:   encodeOption,
+			EncodeProfile:  encodeProfile,
+			Output:         *output,
 			AppConfig:      cfg,
+			Notifier:       notifier,
 		})()
 		select {
 		// wait for either interrupted or retry backoff period
 		case <-interruptCtx.Done():
-			<-afterGracefulInterrupt
-			log.Fatal("Terminated on user interrupt")
+			<-coordinator.Done()
+			log.Println("Terminated on user interrupt")
+			return
 		case <-time.After(*retryBackoffPeriod):
 		}
 	}
 	log.Println("Recording all finished")
+	// Flush and drain the pipeline the same way as on interrupt, so nothing is abandoned on exit
+	coordinator.Shutdown()
 }
@@ -1,34 +1,22 @@
 package cmd
 
 import (
-	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/jzhang046/croned-twitcasting-recorder-mp4/sink"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/shutdown"
 )
 
-const terminationGraceDuration = 3 * time.Second
-
-func newInterruptableCtx() (context.Context, <-chan struct{}) {
+// handleInterrupt starts the shutdown sequence of coordinator on user interrupt.
+func handleInterrupt(coordinator *shutdown.Coordinator) {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
-	rootCtx, cancelOnInterrupt := context.WithCancel(context.Background())
-	afterGraceTermination := make(chan struct{})
-
 	go func() {
 		<-interrupt
-		sink.IsTerminating = true
-		log.Printf("Terminating in %s.. \n", terminationGraceDuration)
-		cancelOnInterrupt()
-		time.Sleep(terminationGraceDuration)
-
-		close(afterGraceTermination)
+		log.Println("Interrupt received")
+		coordinator.Shutdown()
 	}()
-
-	return rootCtx, afterGraceTermination
 }
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/sink"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/uploader"
+)
+
+const VerifyCmdName = "verify"
+
+var errMissingLocally = errors.New("missing locally")
+
+// Verify checks the files listed in one or more manifests against their recorded size and SHA-256,
+// either locally next to the manifest or in the bucket. It exits non-zero if anything does not match.
+func Verify(args []string, defaultUploader uploader.Uploader) {
+	verifyCmd := flag.NewFlagSet(VerifyCmdName, flag.ExitOnError)
+	remote := verifyCmd.Bool("remote", false, "[optional] verify the uploaded objects instead of local files")
+	target := verifyCmd.String(
+		"target",
+		"",
+		"[optional] with -remote and several upload targets, the target to read objects from; default the first holding them",
+	)
+	allowMissing := verifyCmd.Bool(
+		"allow-missing",
+		false,
+		"[optional] skip files missing locally, such as raw captures removed after conversion",
+	)
+	identity := verifyCmd.String(
+		"identity",
+		"",
+		"[optional] with -remote, age identity file or SSH private key to decrypt encrypted objects with",
+	)
+	verifyCmd.Usage = func() {
+		fmt.Fprintf(verifyCmd.Output(), "Usage: %s [options] <manifest.json>...\n", VerifyCmdName)
+		verifyCmd.PrintDefaults()
+	}
+	verifyCmd.Parse(args)
+
+	if verifyCmd.NArg() == 0 {
+		log.Println("Please provide at least one manifest file")
+		verifyCmd.Usage()
+		os.Exit(1)
+	}
+
+	var identities []age.Identity
+	if *identity != "" {
+		var err error
+		if identities, err = uploader.LoadIdentities(*identity); err != nil {
+			log.Fatalf("Failed to load identity %s: %v", *identity, err)
+		}
+	}
+
+	var fetcher uploader.Fetcher
+	if *remote {
+		remoteUploader := defaultUploader
+		if *target != "" {
+			multi, ok := defaultUploader.(*uploader.MultiUploader)
+			if !ok {
+				log.Fatalln("-target requires several upload targets")
+			}
+			if remoteUploader, ok = multi.Target(*target); !ok {
+				log.Fatalf("Unknown upload target [%s]", *target)
+			}
+		}
+		var ok bool
+		if fetcher, ok = remoteUploader.(uploader.Fetcher); !ok {
+			log.Fatalln("Remote verification requires a configured uploader that can read objects back")
+		}
+	}
+
+	failed := 0
+	for _, manifestPath := range verifyCmd.Args() {
+		manifest, err := sink.ReadManifest(manifestPath)
+		if err != nil {
+			log.Printf("Failed to read manifest %s: %v", manifestPath, err)
+			failed++
+			continue
+		}
+		for _, entry := range manifest.Files {
+			err := verifyEntry(filepath.Dir(manifestPath), entry, fetcher, identities)
+			if errors.Is(err, errMissingLocally) && *allowMissing {
+				log.Printf("SKIP %s: %v", entry.File, err)
+			} else if err != nil {
+				log.Printf("FAIL %s: %v", entry.File, err)
+				failed++
+			} else {
+				log.Printf("OK   %s", entry.File)
+			}
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("Verification failed for %d file(s)", failed)
+		os.Exit(1)
+	}
+	log.Println("All files verified")
+}
+
+// verifyEntry compares a file with its manifest entry. Encrypted objects are compared
+// decrypted, which requires identities.
+func verifyEntry(dir string, entry sink.ManifestEntry, fetcher uploader.Fetcher, identities []age.Identity) error {
+	var size int64
+	var digest string
+	var err error
+	if fetcher != nil {
+		if entry.RemoteKey == "" {
+			return fmt.Errorf("no remote key recorded")
+		}
+		body, fetchErr := fetcher.Fetch(entry.RemoteKey)
+		if fetchErr != nil {
+			return fetchErr
+		}
+		defer body.Close()
+		content, decryptErr := uploader.DecryptIfEncrypted(body, identities)
+		if decryptErr != nil {
+			return fmt.Errorf("decrypting: %w", decryptErr)
+		}
+		size, digest, err = sink.HashReader(content)
+	} else {
+		size, digest, err = sink.HashFile(filepath.Join(dir, entry.File))
+		if os.IsNotExist(err) {
+			return errMissingLocally
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if size != entry.Size {
+		return fmt.Errorf("size %d does not match manifest %d", size, entry.Size)
+	}
+	if digest != entry.SHA256 {
+		return fmt.Errorf("sha256 %s does not match manifest %s", digest, entry.SHA256)
+	}
+	return nil
+}
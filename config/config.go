@@ -3,6 +3,7 @@ package config
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"gopkg.in/yaml.v3"
@@ -18,26 +19,211 @@ func init() {
 	validate = validator.New()
 }
 
-type R2Config struct {
-	Enabled         bool   `yaml:"enabled"`
-	Endpoint        string `yaml:"endpoint"`
-	Bucket          string `yaml:"bucket"`
+// S3Config configures uploads to an S3-compatible bucket. The r2 section accepts the same fields.
+type S3Config struct {
+	Enabled  bool   `yaml:"enabled"`
+	Endpoint string `yaml:"endpoint"`
+	// Region defaults to the AWS environment or shared config, or "auto" for R2.
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	PathStyle bool   `yaml:"path-style"`
+	// Prefix is prepended to every object key.
+	Prefix       string `yaml:"prefix"`
+	StorageClass string `yaml:"storage-class"`
+	SSE          string `yaml:"sse" validate:"omitempty,oneof=AES256 aws:kms aws:kms:dsse"`
+	SSEKMSKeyID  string `yaml:"sse-kms-key-id"`
+	// Without static keys, credentials come from the standard AWS chain (environment, shared config, instance role).
 	AccessKeyID     string `yaml:"access-key-id"`
 	SecretAccessKey string `yaml:"secret-access-key"`
+	// Files larger than PartSizeMB are uploaded in parts, Concurrency parts at a time.
+	PartSizeMB  int `yaml:"part-size-mb" validate:"omitempty,gte=5"`
+	Concurrency int `yaml:"concurrency" validate:"gte=0"`
+	// StateFile keeps the progress of multipart uploads so that they resume after a restart.
+	StateFile string `yaml:"state-file"`
+	// AbortOrphansAfter aborts unknown multipart uploads under Prefix older than this.
+	AbortOrphansAfter time.Duration `yaml:"abort-orphans-after" validate:"gte=0"`
+	// LiveUpload uploads the raw capture in parts of LivePartSizeMB while it is recorded.
+	LiveUpload     bool `yaml:"live-upload"`
+	LivePartSizeMB int  `yaml:"live-part-size-mb" validate:"omitempty,gte=5"`
+	// DeleteAfterUpload removes local files once the uploaded object's size and checksum match.
+	DeleteAfterUpload bool `yaml:"delete-after-upload"`
+	// BandwidthLimitKB caps the upload rate of this uploader, in KiB/s.
+	BandwidthLimitKB int `yaml:"bandwidth-limit-kb" validate:"gte=0"`
+}
+
+// LocalConfig configures copying finished files into another directory tree, such as a mounted NAS.
+type LocalConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path" validate:"required_if=Enabled true"`
+	// Move removes the local files once they are copied and verified.
+	Move bool `yaml:"move"`
+	// BandwidthLimitKB caps the copy rate, in KiB/s, for trees mounted over the network.
+	BandwidthLimitKB int `yaml:"bandwidth-limit-kb" validate:"gte=0"`
+}
+
+// WebDAVConfig configures uploads to a WebDAV folder, such as one on Nextcloud.
+type WebDAVConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// URL of the folder files are uploaded into.
+	URL string `yaml:"url" validate:"required_if=Enabled true,omitempty,url"`
+	// Username and Password default to the RECORDER_WEBDAV_USERNAME and RECORDER_WEBDAV_PASSWORD environment variables.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Files larger than ChunkSizeMB are uploaded in chunks into ChunkURL, the Nextcloud uploads collection.
+	ChunkSizeMB int    `yaml:"chunk-size-mb" validate:"gte=0"`
+	ChunkURL    string `yaml:"chunk-url" validate:"omitempty,url"`
+	// DeleteAfterUpload removes local files once the uploaded file is read back and matches.
+	DeleteAfterUpload bool `yaml:"delete-after-upload"`
+	// BandwidthLimitKB caps the upload rate of this uploader, in KiB/s.
+	BandwidthLimitKB int `yaml:"bandwidth-limit-kb" validate:"gte=0"`
+}
+
+// SFTPConfig configures uploads to a folder on an SSH server.
+type SFTPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Host is "host" or "host:port"; the port defaults to 22.
+	Host string `yaml:"host" validate:"required_if=Enabled true"`
+	User string `yaml:"user" validate:"required_if=Enabled true"`
+	Path string `yaml:"path"`
+	// Password defaults to the RECORDER_SFTP_PASSWORD environment variable.
+	Password             string `yaml:"password"`
+	PrivateKey           string `yaml:"private-key"`
+	PrivateKeyPassphrase string `yaml:"private-key-passphrase"`
+	// KnownHosts verifies the server's host key; defaults to ~/.ssh/known_hosts.
+	KnownHosts string `yaml:"known-hosts"`
+	// Concurrency is the number of write requests in flight per file.
+	Concurrency int           `yaml:"concurrency" validate:"gte=0"`
+	Timeout     time.Duration `yaml:"timeout" validate:"gte=0"`
+	// DeleteAfterUpload removes local files once the uploaded file is read back and matches.
+	DeleteAfterUpload bool `yaml:"delete-after-upload"`
+	// BandwidthLimitKB caps the upload rate of this uploader, in KiB/s.
+	BandwidthLimitKB int `yaml:"bandwidth-limit-kb" validate:"gte=0"`
+}
+
+type UploadConfig struct {
+	// KeyTemplate lays out remote keys, e.g. "{{streamer}}/{{yyyy}}/{{mm}}/{{basename}}".
+	KeyTemplate string `yaml:"key-template"`
+	// BandwidthLimitKB caps the total upload rate of all uploads, in KiB/s.
+	BandwidthLimitKB int `yaml:"bandwidth-limit-kb" validate:"gte=0"`
+	// Windows are daily "HH:MM-HH:MM" ranges in local time; uploads are held until one is open.
+	Windows []string `yaml:"windows"`
+	// WhileRecording is "throttle" to cap uploads at RecordingBandwidthLimitKB while any recording is active,
+	// or "pause" to hold them until no recording is active.
+	WhileRecording            string `yaml:"while-recording" validate:"omitempty,oneof=throttle pause"`
+	RecordingBandwidthLimitKB int    `yaml:"recording-bandwidth-limit-kb" validate:"required_if=WhileRecording throttle,gte=0"`
+	// PendingFile keeps the uploads not completed yet, so that they are retried on the next start.
+	PendingFile string `yaml:"pending-file"`
+}
+
+// EncryptionConfig encrypts files with age before they are uploaded.
+type EncryptionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Recipients are age ("age1...") or SSH public keys; the identity of any of them can decrypt.
+	Recipients []string `yaml:"recipients" validate:"required_if=Enabled true"`
+	// KeyID is stored with encrypted objects to tell which key decrypts them; defaults to a fingerprint of the recipients.
+	KeyID string `yaml:"key-id"`
+	// MembershipOnly only encrypts recordings of membership streams.
+	MembershipOnly bool `yaml:"membership-only"`
 }
 
 type TwitcastingConfig struct {
 	Cookie string `yaml:"cookie"`
 }
 
+type HookConfig struct {
+	Command string        `yaml:"command" validate:"required"`
+	Args    []string      `yaml:"args"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type HooksConfig struct {
+	OnRecordStart []*HookConfig `yaml:"on-record-start" validate:"dive"`
+	OnRecordEnd   []*HookConfig `yaml:"on-record-end" validate:"dive"`
+	OnConvertDone []*HookConfig `yaml:"on-convert-done" validate:"dive"`
+	OnUploadDone  []*HookConfig `yaml:"on-upload-done" validate:"dive"`
+	OnFailure     []*HookConfig `yaml:"on-failure" validate:"dive"`
+}
+
+type WebhookConfig struct {
+	// Type is "discord", "slack", or "generic" for the notification posted as JSON with its message.
+	Type string `yaml:"type" validate:"required,oneof=discord slack generic"`
+	URL  string `yaml:"url" validate:"required,url"`
+	// Events limits the webhook to some events; empty means all.
+	Events []string `yaml:"events" validate:"dive,oneof=stream-detected record-started record-ended convert-failed upload-done membership-auth-failed"`
+	// Streamers limits the webhook to these screen IDs; empty means all.
+	Streamers []string `yaml:"streamers"`
+	// Templates replaces the default messages of events with Go templates of the notification.
+	Templates map[string]string `yaml:"templates" validate:"dive,keys,oneof=stream-detected record-started record-ended convert-failed upload-done membership-auth-failed,endkeys"`
+	// Retries is the number of retries of a failed delivery, 3 if not set; 0 disables retries.
+	Retries *int          `yaml:"retries" validate:"omitempty,gte=0"`
+	Timeout time.Duration `yaml:"timeout" validate:"gte=0"`
+}
+
+type SinkConfig struct {
+	// MemoryBufferMB bounds the data kept in memory while the disk falls behind; the rest spills to SpillDir.
+	MemoryBufferMB int    `yaml:"memory-buffer-mb" validate:"gte=0"`
+	SpillDir       string `yaml:"spill-dir"`
+}
+
+type ConvertConfig struct {
+	// Concurrency is the number of ffmpeg conversions allowed to run at once.
+	Concurrency int    `yaml:"concurrency" validate:"gte=0"`
+	QueueFile   string `yaml:"queue-file"`
+	// Timeout kills an ffmpeg run taking longer than this; zero means no limit.
+	Timeout time.Duration `yaml:"timeout" validate:"gte=0"`
+	// OnShutdown decides whether running conversions are finished or cancelled (and resumed on next start).
+	OnShutdown string `yaml:"on-shutdown" validate:"omitempty,oneof=finish cancel"`
+	// SkipVerify removes the source right after ffmpeg succeeds, without checking the converted files.
+	SkipVerify bool `yaml:"skip-verify"`
+	// DurationTolerance is the allowed duration difference between the source and converted files.
+	DurationTolerance time.Duration `yaml:"duration-tolerance" validate:"gte=0"`
+}
+
+type ShutdownConfig struct {
+	// GracePeriod bounds how long flushing, conversions and uploads may take after an interrupt.
+	GracePeriod   time.Duration `yaml:"grace-period" validate:"gte=0"`
+	FinishUploads bool          `yaml:"finish-uploads"`
+}
+
+type StatusConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Listen is the address of the status HTTP server, "127.0.0.1:8080" by default.
+	Listen string `yaml:"listen"`
+	// Actions enables the actions of the dashboard and API, such as stopping recordings.
+	Actions bool `yaml:"actions"`
+	// Token is required on every request, as a bearer token or basic auth password.
+	// It defaults to the RECORDER_STATUS_TOKEN environment variable.
+	Token string `yaml:"token"`
+}
+
+type StreamerConfig struct {
+	ScreenId     string  `yaml:"screen-id" validate:"required"`
+	Schedule     string  `yaml:"schedule" validate:"required"`
+	EncodeOption *string `yaml:"encode-option"`
+	// Profile names an entry of encode-profiles; it replaces encode-option.
+	Profile string `yaml:"profile"`
+	// Output selects the converted files: "mp4" (default), "m4a" (audio only) or "both".
+	Output string `yaml:"output" validate:"omitempty,oneof=mp4 m4a both"`
+}
+
 type Config struct {
-	Streamers []*struct {
-		ScreenId     string  `yaml:"screen-id" validate:"required"`
-		Schedule     string  `yaml:"schedule" validate:"required"`
-		EncodeOption *string `yaml:"encode-option"`
-	} `yaml:"streamers" validate:"dive"`
-	R2          *R2Config          `yaml:"r2"`
-	Twitcasting *TwitcastingConfig `yaml:"twitcasting"`
+	Streamers      []*StreamerConfig         `yaml:"streamers" validate:"dive"`
+	EncodeProfiles map[string]*EncodeProfile `yaml:"encode-profiles" validate:"dive"`
+	R2             *S3Config                 `yaml:"r2"`
+	S3             *S3Config                 `yaml:"s3"`
+	Local          *LocalConfig              `yaml:"local"`
+	WebDAV         *WebDAVConfig             `yaml:"webdav"`
+	SFTP           *SFTPConfig               `yaml:"sftp"`
+	Targets        []*UploadTarget           `yaml:"targets" validate:"dive"`
+	Encryption     *EncryptionConfig         `yaml:"encryption"`
+	Upload         *UploadConfig             `yaml:"upload"`
+	Twitcasting    *TwitcastingConfig        `yaml:"twitcasting"`
+	Hooks          *HooksConfig              `yaml:"hooks"`
+	Webhooks       []*WebhookConfig          `yaml:"webhooks" validate:"dive"`
+	Sink           *SinkConfig               `yaml:"sink"`
+	Convert        *ConvertConfig            `yaml:"convert"`
+	Shutdown       *ShutdownConfig           `yaml:"shutdown"`
+	Status         *StatusConfig             `yaml:"status"`
 }
 
 func GetDefaultConfig() *Config {
@@ -65,5 +251,28 @@ func parseConfig(configPath string) (*Config, error) {
 		return nil, err
 	}
 
-	return config, validate.Struct(config)
+	config.enableTargetBackends()
+	if err := validate.Struct(config); err != nil {
+		return config, err
+	}
+	if err := config.validateTargets(); err != nil {
+		return config, err
+	}
+	if config.Upload != nil {
+		if err := validateKeyTemplate(config.Upload.KeyTemplate); err != nil {
+			return config, err
+		}
+		if err := config.validateKeyTemplateEncryption(); err != nil {
+			return config, err
+		}
+		for _, window := range config.Upload.Windows {
+			if _, err := ParseUploadWindow(window); err != nil {
+				return config, err
+			}
+		}
+		if err := config.validateLiveUpload(); err != nil {
+			return config, err
+		}
+	}
+	return config, config.validateEncodeProfiles()
 }
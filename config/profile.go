@@ -0,0 +1,129 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const DefaultEncodeProfile = "copy"
+
+// containerFormats maps supported containers to their ffmpeg muxer names.
+var containerFormats = map[string]string{
+	"mp4": "mp4",
+	"mov": "mov",
+	"mkv": "matroska",
+}
+
+type EncodeProfile struct {
+	VideoCodec string   `yaml:"video-codec" json:"video_codec"`
+	VideoArgs  []string `yaml:"video-args" json:"video_args,omitempty"`
+	AudioCodec string   `yaml:"audio-codec" json:"audio_codec"`
+	AudioArgs  []string `yaml:"audio-args" json:"audio_args,omitempty"`
+	InputArgs  []string `yaml:"input-args" json:"input_args,omitempty"`
+	OutputArgs []string `yaml:"output-args" json:"output_args,omitempty"`
+	Container  string   `yaml:"container" json:"container" validate:"omitempty,oneof=mp4 mov mkv"`
+	Extension  string   `yaml:"extension" json:"extension"`
+	// Faststart moves the index to the front of mp4/mov files so they can play while downloading.
+	Faststart bool `yaml:"faststart" json:"faststart,omitempty"`
+}
+
+// Format returns the ffmpeg muxer name of the profile's container.
+func (p *EncodeProfile) Format() string {
+	return containerFormats[p.Container]
+}
+
+// applyDefaults fills in stream copy into an mp4 container for anything left unset.
+func (p *EncodeProfile) applyDefaults() {
+	if p.VideoCodec == "" {
+		p.VideoCodec = "copy"
+	}
+	if p.AudioCodec == "" {
+		p.AudioCodec = "copy"
+	}
+	if p.Container == "" {
+		p.Container = "mp4"
+	}
+	if p.Extension == "" {
+		p.Extension = p.Container
+	}
+	p.Extension = strings.TrimPrefix(p.Extension, ".")
+}
+
+// ValidateOutput refuses extensions that would make the converted video file overwrite the capture
+// or, with the given output, the audio file.
+func (p *EncodeProfile) ValidateOutput(output string) error {
+	switch {
+	case strings.ContainsAny(p.Extension, `/\`):
+		return fmt.Errorf("extension %q must not contain path separators", p.Extension)
+	case strings.EqualFold(p.Extension, "ts"):
+		return errors.New("extension ts would overwrite the recording")
+	case strings.EqualFold(p.Extension, "m4a") && output == "both":
+		return errors.New("extension m4a collides with the audio file of output both")
+	}
+	return nil
+}
+
+// EncodeProfileFromOption builds a profile from a legacy encode-option string,
+// which holds the video codec followed by its arguments.
+func EncodeProfileFromOption(encodeOption string) *EncodeProfile {
+	profile := &EncodeProfile{}
+	if fields := strings.Fields(encodeOption); len(fields) > 0 {
+		profile.VideoCodec = fields[0]
+		profile.VideoArgs = fields[1:]
+	}
+	profile.applyDefaults()
+	return profile
+}
+
+// GetEncodeProfile returns the named profile, including the built-in copy profile.
+func (c *Config) GetEncodeProfile(name string) (*EncodeProfile, error) {
+	if profile, ok := c.EncodeProfiles[name]; ok {
+		return profile, nil
+	}
+	if name == DefaultEncodeProfile {
+		return EncodeProfileFromOption(""), nil
+	}
+	return nil, fmt.Errorf("encode profile [%s] is not defined", name)
+}
+
+// StreamerEncodeProfile resolves the profile of a streamer: its named profile,
+// its legacy encode-option, or the built-in copy profile.
+func (c *Config) StreamerEncodeProfile(streamer *StreamerConfig) (*EncodeProfile, error) {
+	if streamer.Profile != "" {
+		return c.GetEncodeProfile(streamer.Profile)
+	}
+	if streamer.EncodeOption != nil {
+		return EncodeProfileFromOption(*streamer.EncodeOption), nil
+	}
+	return c.GetEncodeProfile(DefaultEncodeProfile)
+}
+
+func (c *Config) validateEncodeProfiles() error {
+	for name, profile := range c.EncodeProfiles {
+		if profile == nil {
+			return fmt.Errorf("encode profile [%s] is empty", name)
+		}
+		profile.applyDefaults()
+		if profile.Faststart && profile.Container == "mkv" {
+			return fmt.Errorf("encode profile [%s]: faststart is not supported by mkv", name)
+		}
+		if err := profile.ValidateOutput(""); err != nil {
+			return fmt.Errorf("encode profile [%s]: %w", name, err)
+		}
+	}
+
+	for _, streamer := range c.Streamers {
+		if streamer.Profile != "" && streamer.EncodeOption != nil {
+			return fmt.Errorf("streamer [%s]: profile and encode-option cannot be used together", streamer.ScreenId)
+		}
+		profile, err := c.StreamerEncodeProfile(streamer)
+		if err == nil {
+			err = profile.ValidateOutput(streamer.Output)
+		}
+		if err != nil {
+			return fmt.Errorf("streamer [%s]: %w", streamer.ScreenId, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// UploadTarget is one destination of uploads: exactly one backend, and filters choosing the files it receives.
+type UploadTarget struct {
+	Name   string        `yaml:"name" validate:"required"`
+	R2     *S3Config     `yaml:"r2"`
+	S3     *S3Config     `yaml:"s3"`
+	Local  *LocalConfig  `yaml:"local"`
+	WebDAV *WebDAVConfig `yaml:"webdav"`
+	SFTP   *SFTPConfig   `yaml:"sftp"`
+	// Artifacts limits the target to some of "raw" (the .ts capture), "mp4" (converted files)
+	// and "sidecars" (info and manifest files); empty means all.
+	Artifacts []string `yaml:"artifacts" validate:"dive,oneof=raw mp4 sidecars"`
+	// Streamers limits the target to recordings of these screen IDs; empty means all.
+	Streamers []string `yaml:"streamers"`
+	// Membership is "only" to take only membership streams, or "exclude" to skip them.
+	Membership string `yaml:"membership" validate:"omitempty,oneof=only exclude"`
+	// Encryption replaces the top-level encryption for this target.
+	Encryption *EncryptionConfig `yaml:"encryption"`
+}
+
+func (t *UploadTarget) backends() int {
+	count := 0
+	for _, present := range []bool{t.R2 != nil, t.S3 != nil, t.Local != nil, t.WebDAV != nil, t.SFTP != nil} {
+		if present {
+			count++
+		}
+	}
+	return count
+}
+
+// enableTargetBackends enables the backend of each target, which needs no enabled flag of its own.
+// It runs before validation, so that the backend's required fields are checked.
+func (c *Config) enableTargetBackends() {
+	for _, target := range c.Targets {
+		if target == nil {
+			continue
+		}
+		if target.R2 != nil {
+			target.R2.Enabled = true
+		}
+		if target.S3 != nil {
+			target.S3.Enabled = true
+		}
+		if target.Local != nil {
+			target.Local.Enabled = true
+		}
+		if target.WebDAV != nil {
+			target.WebDAV.Enabled = true
+		}
+		if target.SFTP != nil {
+			target.SFTP.Enabled = true
+		}
+	}
+}
+
+func (c *Config) validateTargets() error {
+	for _, target := range c.Targets {
+		if target == nil {
+			return errors.New("targets contains an empty target")
+		}
+	}
+	names := make(map[string]bool)
+	for _, target := range c.UploadTargets() {
+		if target.backends() != 1 {
+			return fmt.Errorf("target [%s] needs exactly one of r2, s3, local, webdav and sftp", target.Name)
+		}
+		if names[target.Name] {
+			return fmt.Errorf("target [%s] is defined more than once", target.Name)
+		}
+		names[target.Name] = true
+	}
+	return nil
+}
+
+// UploadTargets returns the enabled top-level uploaders, each named after its section, followed by the targets.
+// Targets without an encryption section of their own get the top-level one.
+func (c *Config) UploadTargets() []*UploadTarget {
+	var targets []*UploadTarget
+	if c.R2 != nil && c.R2.Enabled {
+		targets = append(targets, &UploadTarget{Name: "r2", R2: c.R2, Encryption: c.Encryption})
+	}
+	if c.S3 != nil && c.S3.Enabled {
+		targets = append(targets, &UploadTarget{Name: "s3", S3: c.S3, Encryption: c.Encryption})
+	}
+	if c.Local != nil && c.Local.Enabled {
+		targets = append(targets, &UploadTarget{Name: "local", Local: c.Local, Encryption: c.Encryption})
+	}
+	if c.WebDAV != nil && c.WebDAV.Enabled {
+		targets = append(targets, &UploadTarget{Name: "webdav", WebDAV: c.WebDAV, Encryption: c.Encryption})
+	}
+	if c.SFTP != nil && c.SFTP.Enabled {
+		targets = append(targets, &UploadTarget{Name: "sftp", SFTP: c.SFTP, Encryption: c.Encryption})
+	}
+	for _, target := range c.Targets {
+		if target == nil {
+			continue
+		}
+		if target.Encryption == nil {
+			withEncryption := *target
+			withEncryption.Encryption = c.Encryption
+			target = &withEncryption
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultKeyTemplate = "{{streamer}}-{{basename}}"
+
+// KeyTemplateFields are the placeholders available in key templates.
+var KeyTemplateFields = []string{"streamer", "title", "movie_id", "yyyy", "mm", "dd", "hh", "basename"}
+
+var keyTemplatePlaceholder = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// ExpandKeyTemplate replaces each {{field}} placeholder of template with its value.
+func ExpandKeyTemplate(template string, values map[string]string) string {
+	return keyTemplatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return values[keyTemplatePlaceholder.FindStringSubmatch(placeholder)[1]]
+	})
+}
+
+func validateKeyTemplate(template string) error {
+	for _, match := range keyTemplatePlaceholder.FindAllStringSubmatch(template, -1) {
+		if !slices.Contains(KeyTemplateFields, match[1]) {
+			return fmt.Errorf("key-template: unknown placeholder {{%s}}; available: %v", match[1], KeyTemplateFields)
+		}
+	}
+	return nil
+}
+
+// validateKeyTemplateEncryption refuses {{title}} in the key template when files are encrypted,
+// as remote keys are not encrypted.
+func (c *Config) validateKeyTemplateEncryption() error {
+	usesTitle := slices.ContainsFunc(keyTemplatePlaceholder.FindAllStringSubmatch(c.Upload.KeyTemplate, -1), func(match []string) bool {
+		return match[1] == "title"
+	})
+	if !usesTitle {
+		return nil
+	}
+	for _, target := range c.UploadTargets() {
+		if target.Encryption != nil && target.Encryption.Enabled {
+			return fmt.Errorf("target [%s]: key-template cannot contain {{title}} when files are encrypted", target.Name)
+		}
+	}
+	return nil
+}
+
+// validateLiveUpload refuses live uploads together with upload holds, as live parts cannot wait for them.
+func (c *Config) validateLiveUpload() error {
+	if len(c.Upload.Windows) == 0 && c.Upload.WhileRecording != "pause" {
+		return nil
+	}
+	for _, target := range c.UploadTargets() {
+		for _, s3 := range []*S3Config{target.R2, target.S3} {
+			if s3 != nil && s3.LiveUpload {
+				return fmt.Errorf("target [%s]: live-upload cannot be combined with upload windows or while-recording: pause", target.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// UploadWindow is a daily range of local time, as minutes since midnight. Windows ending before they
+// start wrap around midnight, such as 22:00-06:00.
+type UploadWindow struct {
+	Start, End int
+}
+
+var uploadWindowPattern = regexp.MustCompile(`^(\d{1,2}):(\d{2})\s*-\s*(\d{1,2}):(\d{2})$`)
+
+// ParseUploadWindow parses an "HH:MM-HH:MM" upload window.
+func ParseUploadWindow(window string) (UploadWindow, error) {
+	match := uploadWindowPattern.FindStringSubmatch(strings.TrimSpace(window))
+	if match == nil {
+		return UploadWindow{}, fmt.Errorf("windows: %q is not HH:MM-HH:MM", window)
+	}
+	minutes := make([]int, 2)
+	for i := range minutes {
+		hour, _ := strconv.Atoi(match[1+2*i])
+		minute, _ := strconv.Atoi(match[2+2*i])
+		if hour > 24 || minute > 59 || hour == 24 && minute > 0 {
+			return UploadWindow{}, fmt.Errorf("windows: %q is not a valid time range", window)
+		}
+		minutes[i] = hour*60 + minute
+	}
+	if minutes[0] == minutes[1] {
+		return UploadWindow{}, fmt.Errorf("windows: %q is empty", window)
+	}
+	return UploadWindow{Start: minutes[0], End: minutes[1]}, nil
+}
+
+// Contains reports whether t falls within the window.
+func (w UploadWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return w.Start <= minute && minute < w.End
+	}
+	return minute >= w.Start || minute < w.End
+}
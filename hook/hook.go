@@ -0,0 +1,138 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+const (
+	defaultHookTimeout = time.Minute
+	maxCapturedOutput  = 4096
+	// hookWaitDelay bounds the wait for output after a timed-out hook is killed, since children it started may
+	// still hold its stdout and stderr.
+	hookWaitDelay = 5 * time.Second
+)
+
+type Event string
+
+const (
+	OnRecordStart Event = "on-record-start"
+	OnRecordEnd   Event = "on-record-end"
+	OnConvertDone Event = "on-convert-done"
+	OnUploadDone  Event = "on-upload-done"
+	OnFailure     Event = "on-failure"
+)
+
+// Payload describes a recording session; it is written to the hook command's stdin as JSON.
+type Payload struct {
+	Event         Event  `json:"event"`
+	Streamer      string `json:"streamer"`
+	Title         string `json:"title"`
+	IsMembership  bool   `json:"is_membership"`
+	TsFilePath    string `json:"ts_file_path,omitempty"`
+	TsFileSize    int64  `json:"ts_file_size,omitempty"`
+	VideoFilePath string `json:"video_file_path,omitempty"`
+	VideoFileSize int64  `json:"video_file_size,omitempty"`
+	M4aFilePath   string `json:"m4a_file_path,omitempty"`
+	M4aFileSize   int64  `json:"m4a_file_size,omitempty"`
+	// Mp4FilePath and Mp4FileSize repeat the video file under the keys used before encode profiles.
+	Mp4FilePath     string  `json:"mp4_file_path,omitempty"`
+	Mp4FileSize     int64   `json:"mp4_file_size,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	RemoteKey       string  `json:"remote_key,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// Runner executes the user commands configured for each event.
+// A nil Runner is valid and runs nothing.
+type Runner struct {
+	hooks map[Event][]*config.HookConfig
+}
+
+func NewRunner(cfg *config.HooksConfig) *Runner {
+	if cfg == nil {
+		return nil
+	}
+	return &Runner{
+		hooks: map[Event][]*config.HookConfig{
+			OnRecordStart: cfg.OnRecordStart,
+			OnRecordEnd:   cfg.OnRecordEnd,
+			OnConvertDone: cfg.OnConvertDone,
+			OnUploadDone:  cfg.OnUploadDone,
+			OnFailure:     cfg.OnFailure,
+		},
+	}
+}
+
+// Fire runs all hooks registered for the payload's event in the background, one after another.
+func (r *Runner) Fire(payload Payload) {
+	if r == nil || len(r.hooks[payload.Event]) == 0 {
+		return
+	}
+
+	input, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode payload for hook [%s]: %v", payload.Event, err)
+		return
+	}
+
+	go func() {
+		for _, hookCfg := range r.hooks[payload.Event] {
+			run(payload.Event, hookCfg, input)
+		}
+	}()
+}
+
+func run(event Event, hookCfg *config.HookConfig, input []byte) {
+	timeout := hookCfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output := &limitedBuffer{limit: maxCapturedOutput}
+	hookCmd := exec.CommandContext(ctx, hookCfg.Command, hookCfg.Args...)
+	hookCmd.WaitDelay = hookWaitDelay
+	hookCmd.Stdin = bytes.NewReader(input)
+	hookCmd.Stdout = output
+	hookCmd.Stderr = output
+	hookCmd.Env = append(os.Environ(), "RECORDER_HOOK_EVENT="+string(event))
+
+	start := time.Now()
+	err := hookCmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("Hook [%s] %s timed out after %s; output: %s", event, hookCfg.Command, timeout, output)
+		return
+	}
+	if err != nil {
+		log.Printf("Hook [%s] %s failed: %v; output: %s", event, hookCfg.Command, err, output)
+		return
+	}
+	log.Printf("Hook [%s] %s completed in %s; output: %s", event, hookCfg.Command, time.Since(start).Round(time.Millisecond), output)
+}
+
+// limitedBuffer keeps only the last limit bytes written to it.
+type limitedBuffer struct {
+	buf   []byte
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.buf = b.buf[len(b.buf)-b.limit:]
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return string(bytes.TrimSpace(b.buf))
+}
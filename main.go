@@ -8,8 +8,12 @@ import (
 
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/cmd"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/hook"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/notify"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/record"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/shutdown"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/sink"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/status"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/uploader"
 )
 
@@ -19,36 +23,49 @@ func init() {
 	log.SetOutput(os.Stdout)
 }
 
-var availableCmds = []string{cmd.CronedRecordCmdName, cmd.DirectRecordCmdName}
+var availableCmds = []string{cmd.CronedRecordCmdName, cmd.DirectRecordCmdName, cmd.VerifyCmdName, cmd.DecryptCmdName}
 
 func main() {
+	// Decrypting needs no configuration.
+	if len(os.Args) >= 2 && os.Args[1] == cmd.DecryptCmdName {
+		cmd.Decrypt(os.Args[2:])
+		return
+	}
+
 	cfg := config.GetDefaultConfig()
 
-	var defaultUploader uploader.Uploader
-	var err error
-	if cfg.R2 != nil && cfg.R2.Enabled {
-		defaultUploader, err = uploader.NewR2Uploader(cfg.R2)
-		if err != nil {
-			log.Printf("Failed to initialize R2 defaultUploader: %v. Upload will be disabled.", err)
-			defaultUploader = nil // Ensure defaultUploader is nil on error
-		} else {
-			log.Println("R2 defaultUploader initialized.")
-		}
+	limits := uploader.NewLimits(cfg.Upload)
+	defaultUploader := uploader.New(cfg.UploadTargets(), limits)
+
+	if len(os.Args) >= 2 && os.Args[1] == cmd.VerifyCmdName {
+		cmd.Verify(os.Args[2:], defaultUploader)
+		return
 	}
 
+	coordinator := shutdown.NewCoordinator(cfg.Shutdown)
+	limits.SetContext(coordinator.Context())
+	limits.SetRecordingActive(func() bool {
+		return coordinator.Active(shutdown.StageWriter) > 0
+	})
+	notifier := notify.NewNotifier(cfg.Webhooks)
+	pipeline := sink.NewPipeline(cfg, defaultUploader, hook.NewRunner(cfg.Hooks), notifier, coordinator)
+	pipeline.Start()
+	statusServer := status.NewServer(cfg.Status, pipeline)
+	statusServer.Start()
+
 	sinkProvider := func(recordCtx record.RecordContext) (chan<- []byte, string, error) {
-		return sink.NewFileSink(recordCtx, defaultUploader)
+		return sink.NewFileSink(recordCtx, pipeline)
 	}
 
 	if len(os.Args) < 2 {
 		log.Println("Record mode not specified; supported modes:", availableCmds)
-		cmd.RecordCroned(cfg, sinkProvider)
+		cmd.RecordCroned(cfg, sinkProvider, notifier, coordinator, statusServer)
 	} else {
 		switch os.Args[1] {
 		case cmd.CronedRecordCmdName:
-			cmd.RecordCroned(cfg, sinkProvider)
+			cmd.RecordCroned(cfg, sinkProvider, notifier, coordinator, statusServer)
 		case cmd.DirectRecordCmdName:
-			cmd.RecordDirect(cfg, os.Args[2:], sinkProvider)
+			cmd.RecordDirect(cfg, os.Args[2:], sinkProvider, notifier, coordinator)
 		default:
 			log.Fatalf(
 				"Unknown record mode [%s]; supported modes: %s",
@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+type Event string
+
+const (
+	StreamDetected       Event = "stream-detected"
+	RecordStarted        Event = "record-started"
+	RecordEnded          Event = "record-ended"
+	ConvertFailed        Event = "convert-failed"
+	UploadDone           Event = "upload-done"
+	MembershipAuthFailed Event = "membership-auth-failed"
+)
+
+// Notification describes something that happened to a recording; it is what message templates are executed with.
+type Notification struct {
+	Event           Event     `json:"event"`
+	Time            time.Time `json:"time"`
+	Streamer        string    `json:"streamer"`
+	Title           string    `json:"title,omitempty"`
+	MovieID         string    `json:"movie_id,omitempty"`
+	URL             string    `json:"url,omitempty"`
+	IsMembership    bool      `json:"is_membership"`
+	FilePath        string    `json:"file_path,omitempty"`
+	Size            int64     `json:"size,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds,omitempty"`
+	RemoteKey       string    `json:"remote_key,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// Notifier posts notifications to the configured webhooks.
+// A nil Notifier is valid and sends nothing.
+type Notifier struct {
+	webhooks []*webhook
+
+	mu       sync.Mutex
+	detected map[string]string
+}
+
+func NewNotifier(cfgs []*config.WebhookConfig) *Notifier {
+	var webhooks []*webhook
+	for i, cfg := range cfgs {
+		w, err := newWebhook(cfg)
+		if err != nil {
+			log.Printf("Failed to initialize webhook #%d (%s); it is disabled: %v", i+1, cfg.Type, err)
+			continue
+		}
+		webhooks = append(webhooks, w)
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+	return &Notifier{webhooks: webhooks, detected: make(map[string]string)}
+}
+
+// Notify sends the notification in the background to every webhook taking its event and streamer.
+// A stream is only notified as detected once per movie, however often it is checked.
+func (n *Notifier) Notify(notification Notification) {
+	if n == nil {
+		return
+	}
+	if notification.Event == StreamDetected && !n.newlyDetected(notification.Streamer, notification.MovieID) {
+		return
+	}
+	if notification.Time.IsZero() {
+		notification.Time = time.Now()
+	}
+	for _, w := range n.webhooks {
+		if w.accepts(notification) {
+			go w.send(notification)
+		}
+	}
+}
+
+func (n *Notifier) newlyDetected(streamer, movieId string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if movieId != "" && n.detected[streamer] == movieId {
+		return false
+	}
+	n.detected[streamer] = movieId
+	return true
+}
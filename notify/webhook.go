@@ -0,0 +1,177 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+const (
+	webhookDiscord = "discord"
+	webhookSlack   = "slack"
+	webhookGeneric = "generic"
+
+	defaultWebhookRetries = 3
+	defaultWebhookTimeout = 10 * time.Second
+	firstRetryDelay       = 2 * time.Second
+	maxRetryDelay         = time.Minute
+	maxDiscordContent     = 2000
+)
+
+var defaultTemplates = map[Event]string{
+	StreamDetected:       `{{.Streamer}} is live: {{.Title}}{{if .IsMembership}} (membership){{end}}{{if .URL}} {{.URL}}{{end}}`,
+	RecordStarted:        `Recording {{.Streamer}}: {{.Title}}`,
+	RecordEnded:          `Finished recording {{.Streamer}}: {{.Title}} ({{duration .DurationSeconds}}, {{size .Size}})`,
+	ConvertFailed:        `Failed to convert {{.FilePath}} of {{.Streamer}}: {{.Error}}`,
+	UploadDone:           `Uploaded {{.RemoteKey}} of {{.Streamer}} ({{size .Size}})`,
+	MembershipAuthFailed: `Cannot record the membership stream of {{.Streamer}}: {{.Error}}`,
+}
+
+var templateFuncs = template.FuncMap{
+	"size":     formatSize,
+	"duration": formatDuration,
+}
+
+type webhook struct {
+	kind      string
+	url       string
+	events    []string
+	streamers []string
+	templates map[Event]*template.Template
+	retries   int
+	client    *http.Client
+}
+
+func newWebhook(cfg *config.WebhookConfig) (*webhook, error) {
+	w := &webhook{
+		kind:      cfg.Type,
+		url:       cfg.URL,
+		events:    cfg.Events,
+		streamers: cfg.Streamers,
+		templates: make(map[Event]*template.Template),
+		retries:   defaultWebhookRetries,
+		client:    &http.Client{Timeout: cfg.Timeout},
+	}
+	if cfg.Retries != nil {
+		w.retries = *cfg.Retries
+	}
+	if w.client.Timeout <= 0 {
+		w.client.Timeout = defaultWebhookTimeout
+	}
+	for event, text := range defaultTemplates {
+		if custom, ok := cfg.Templates[string(event)]; ok {
+			text = custom
+		}
+		tmpl, err := template.New(string(event)).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for %s: %w", event, err)
+		}
+		w.templates[event] = tmpl
+	}
+	return w, nil
+}
+
+func (w *webhook) accepts(n Notification) bool {
+	return (len(w.events) == 0 || slices.Contains(w.events, string(n.Event))) &&
+		(len(w.streamers) == 0 || slices.Contains(w.streamers, n.Streamer))
+}
+
+// send posts the notification, retrying with exponential backoff while the endpoint fails temporarily.
+func (w *webhook) send(n Notification) {
+	body, err := w.body(n)
+	if err != nil {
+		log.Printf("Failed to build %s webhook message for [%s] of %s: %v", w.kind, n.Event, n.Streamer, err)
+		return
+	}
+
+	delay := firstRetryDelay
+	for attempt := 0; ; attempt++ {
+		retryAfter, retryable, err := w.post(body)
+		if err == nil {
+			return
+		}
+		if !retryable || attempt >= w.retries {
+			log.Printf("Failed to send %s webhook [%s] of %s: %v", w.kind, n.Event, n.Streamer, err)
+			return
+		}
+		if retryAfter > 0 {
+			delay = min(retryAfter, maxRetryDelay)
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// body renders the message of the notification into the payload expected by the webhook type.
+func (w *webhook) body(n Notification) ([]byte, error) {
+	var message strings.Builder
+	if err := w.templates[n.Event].Execute(&message, n); err != nil {
+		return nil, err
+	}
+	text := message.String()
+
+	switch w.kind {
+	case webhookDiscord:
+		if runes := []rune(text); len(runes) > maxDiscordContent {
+			text = string(runes[:maxDiscordContent-1]) + "…"
+		}
+		return json.Marshal(map[string]string{"content": text})
+	case webhookSlack:
+		return json.Marshal(map[string]string{"text": text})
+	default:
+		return json.Marshal(struct {
+			Notification
+			Message string `json:"message"`
+		}{n, text})
+	}
+}
+
+// post delivers the body once. Network errors, rate limits and server errors are retryable;
+// the endpoint may tell how long to wait before retrying.
+func (w *webhook) post(body []byte) (time.Duration, bool, error) {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return 0, false, nil
+	}
+
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(detail))
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	var retryAfter time.Duration
+	if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return retryAfter, retryable, err
+}
+
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value, exp := float64(bytes)/unit, 0
+	for value >= unit && exp < 3 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[exp])
+}
+
+func formatDuration(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
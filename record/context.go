@@ -1,6 +1,11 @@
 package record
 
-import "context"
+import (
+	"context"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/types"
+)
 
 type RecordContext interface {
 	// Done would be closed when work done.
@@ -21,11 +26,17 @@ type RecordContext interface {
 	// GetStreamTitle returns stream title of this context.
 	GetStreamTitle() string
 
-	// GetEncodeOption returns ffmpeg video encode options of this context
-	GetEncodeOption() *string
+	// GetEncodeProfile returns the ffmpeg encode profile of this context
+	GetEncodeProfile() *config.EncodeProfile
+
+	// GetOutput returns which converted files to produce: mp4, m4a or both.
+	GetOutput() string
 
 	// IsMembershipStream returns true if the stream is a membership-only stream.
 	IsMembershipStream() bool
+
+	// GetStreamMetadata returns the unsanitized title, description and movie ID of the stream.
+	GetStreamMetadata() types.StreamMetadata
 }
 
 type recordContextImpl struct {
@@ -38,18 +49,22 @@ type contextKey string
 const (
 	streamerKey           = contextKey("streamer")
 	streamUrlKey          = contextKey("streamUrl")
-	encodeOptionKey       = contextKey("encodeOption")
+	encodeProfileKey      = contextKey("encodeProfile")
+	outputKey             = contextKey("output")
 	streamTitleKey        = contextKey("streamTitle")
 	isMembershipStreamKey = contextKey("isMembershipStream")
+	streamMetadataKey     = contextKey("streamMetadata")
 )
 
-func newRecordContext(ctx context.Context, streamer, streamUrl string, streamTitle string, encodeOption *string, isMembership bool) RecordContext {
+func newRecordContext(ctx context.Context, streamer, streamUrl string, streamTitle string, encodeProfile *config.EncodeProfile, output string, isMembership bool, metadata types.StreamMetadata) RecordContext {
 	ctx, cancelFunc := context.WithCancel(ctx)
 	ctx = context.WithValue(ctx, streamUrlKey, streamUrl)
 	ctx = context.WithValue(ctx, streamerKey, streamer)
 	ctx = context.WithValue(ctx, streamTitleKey, streamTitle)
-	ctx = context.WithValue(ctx, encodeOptionKey, encodeOption)
+	ctx = context.WithValue(ctx, encodeProfileKey, encodeProfile)
+	ctx = context.WithValue(ctx, outputKey, output)
 	ctx = context.WithValue(ctx, isMembershipStreamKey, isMembership)
+	ctx = context.WithValue(ctx, streamMetadataKey, metadata)
 	return &recordContextImpl{ctx, cancelFunc}
 }
 
@@ -77,11 +92,19 @@ func (ctxImpl *recordContextImpl) GetStreamTitle() string {
 	return ctxImpl.ctx.Value(streamTitleKey).(string)
 }
 
-func (ctxImpl *recordContextImpl) GetEncodeOption() *string {
-	return ctxImpl.ctx.Value(encodeOptionKey).(*string)
+func (ctxImpl *recordContextImpl) GetEncodeProfile() *config.EncodeProfile {
+	return ctxImpl.ctx.Value(encodeProfileKey).(*config.EncodeProfile)
+}
+
+func (ctxImpl *recordContextImpl) GetOutput() string {
+	return ctxImpl.ctx.Value(outputKey).(string)
 }
 
 func (ctxImpl *recordContextImpl) IsMembershipStream() bool {
 	isMembership, ok := ctxImpl.ctx.Value(isMembershipStreamKey).(bool)
 	return ok && isMembership
 }
+
+func (ctxImpl *recordContextImpl) GetStreamMetadata() types.StreamMetadata {
+	return ctxImpl.ctx.Value(streamMetadataKey).(types.StreamMetadata)
+}
@@ -2,10 +2,12 @@ package record
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"strings"
 
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/notify"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/sink" // Add sink import
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/types"
 )
@@ -16,8 +18,10 @@ type RecordConfig struct {
 	SinkProvider     func(RecordContext) (chan<- []byte, string, error) // Updated signature
 	StreamRecorder   func(recordCtx RecordContext, streamInfo *types.StreamInfo, sinkChan chan<- []byte, cookie string) error
 	RootContext      context.Context
-	EncodeOption     *string
+	EncodeProfile    *config.EncodeProfile
+	Output           string
 	AppConfig        *config.Config
+	Notifier         *notify.Notifier
 }
 
 func ToRecordFunc(recordConfig *RecordConfig) func() {
@@ -36,13 +40,28 @@ func ToRecordFunc(recordConfig *RecordConfig) func() {
 		}
 
 		// Prepare for recording
-		streamTitle, err := GetStreamTitle(streamer)
+		title, titleDescription, err := GetStreamTitle(streamer)
 		if err != nil {
 			log.Printf("Error fetching stream title for streamer [%s]: %v\n", streamer, err)
 		}
+		streamTitle := fmt.Sprintf("%s %s", title, titleDescription)
 		log.Printf("Stream Title is %s\n", streamTitle)
+		metadata := types.StreamMetadata{
+			MovieId:     streamInfo.MovieId,
+			Title:       title,
+			Description: titleDescription,
+			SourceUrl:   GetMovieUrl(streamer, streamInfo.MovieId),
+		}
+		recordConfig.Notifier.Notify(notify.Notification{
+			Event:        notify.StreamDetected,
+			Streamer:     streamer,
+			Title:        title,
+			MovieID:      metadata.MovieId,
+			URL:          metadata.SourceUrl,
+			IsMembership: streamInfo.IsMembershipStream,
+		})
 
-		recordCtx := newRecordContext(recordConfig.RootContext, streamer, streamInfo.Url, streamTitle, recordConfig.EncodeOption, streamInfo.IsMembershipStream)
+		recordCtx := newRecordContext(recordConfig.RootContext, streamer, streamInfo.Url, streamTitle, recordConfig.EncodeProfile, recordConfig.Output, streamInfo.IsMembershipStream, metadata)
 		sinkChan, tsFilePath, err := recordConfig.SinkProvider(recordCtx) // Capture tsFilePath
 		if err != nil {
 			log.Println("Error creating recording file: ", err)
@@ -66,7 +85,9 @@ func ToRecordFunc(recordConfig *RecordConfig) func() {
 			log.Printf("Fetched new stream URL for streamer [%s]: %s. ", streamer, streamInfo.Url)
 
 			// Create new context and sink
-			recordCtx = newRecordContext(recordConfig.RootContext, streamer, streamInfo.Url, streamTitle, recordConfig.EncodeOption, streamInfo.IsMembershipStream)
+			metadata.MovieId = streamInfo.MovieId
+			metadata.SourceUrl = GetMovieUrl(streamer, streamInfo.MovieId)
+			recordCtx = newRecordContext(recordConfig.RootContext, streamer, streamInfo.Url, streamTitle, recordConfig.EncodeProfile, recordConfig.Output, streamInfo.IsMembershipStream, metadata)
 			var retryTsFilePath string
 			sinkChan, retryTsFilePath, err = recordConfig.SinkProvider(recordCtx) // Capture tsFilePath for retry
 			if err != nil {
@@ -79,13 +100,30 @@ func ToRecordFunc(recordConfig *RecordConfig) func() {
 				log.Printf("Recording retry failed for streamer [%s]: %v", streamer, err)
 				if strings.Contains(err.Error(), "bad handshake") {
 					_ = sink.RemoveFileIfSmall(retryTsFilePath, 1024) // Delete file if retry also fails handshake and file is small
+					notifyAuthFailed(recordConfig, metadata, fmt.Errorf("the configured cookie was refused: %w", err))
 				}
 			}
 
 		} else if err != nil {
 			log.Printf("Recording failed for streamer [%s]: %v", streamer, err)
+			if strings.Contains(err.Error(), "bad handshake") {
+				notifyAuthFailed(recordConfig, metadata, fmt.Errorf("no cookie is configured: %w", err))
+			}
 			// Also delete the file if recording failed for other reasons (not a handshake retry) and file is small
 			_ = sink.RemoveFileIfSmall(tsFilePath, 1024)
 		}
 	}
 }
+
+// notifyAuthFailed tells the webhooks that a stream could not be recorded for lack of membership.
+func notifyAuthFailed(recordConfig *RecordConfig, metadata types.StreamMetadata, err error) {
+	recordConfig.Notifier.Notify(notify.Notification{
+		Event:        notify.MembershipAuthFailed,
+		Streamer:     recordConfig.Streamer,
+		Title:        metadata.Title,
+		MovieID:      metadata.MovieId,
+		URL:          metadata.SourceUrl,
+		IsMembership: true,
+		Error:        err.Error(),
+	})
+}
@@ -69,19 +69,20 @@ func extractElementInnerText(node *html.Node) string {
 	return result
 }
 
-func GetStreamTitle(streamer string) (string, error) {
+// GetStreamTitle returns the stream title and title description shown on the streamer's page.
+func GetStreamTitle(streamer string) (string, string, error) {
 	streamPageUrl := fmt.Sprint(baseDomain, "/", streamer)
 	response, err := httpClient.Get(streamPageUrl)
 	if err != nil {
 		log.Println("Failed to get stream page:", err)
-		return "", err
+		return "", "", err
 	}
 	defer response.Body.Close()
 
 	doc, err := html.Parse(response.Body)
 	if err != nil {
 		log.Println("Failed to parse stream page:", err)
-		return "", err
+		return "", "", err
 	}
 
 	titleDivElement := findElementByClassName(doc, streamTitleClassName)
@@ -121,5 +122,13 @@ func GetStreamTitle(streamer string) (string, error) {
 		titleDescription = ""
 	}
 
-	return fmt.Sprintf("%s %s", title, titleDescription), nil
+	return title, titleDescription, nil
+}
+
+// GetMovieUrl returns the page URL of the given live stream, or the streamer's page if the movie ID is unknown.
+func GetMovieUrl(streamer, movieId string) string {
+	if movieId == "" || movieId == "0" {
+		return fmt.Sprint(baseDomain, "/", streamer)
+	}
+	return fmt.Sprint(baseDomain, "/", streamer, "/movie/", movieId)
 }
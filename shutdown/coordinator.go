@@ -0,0 +1,210 @@
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+const defaultGracePeriod = 3 * time.Second
+
+type Stage string
+
+const (
+	StageWriter    Stage = "writer"
+	StageConverter Stage = "converter"
+	StageUploader  Stage = "uploader"
+)
+
+// Drainer is a stage holding queued work that must be finished or persisted on shutdown.
+type Drainer interface {
+	// Drain stops starting new work and finishes or persists the running work before ctx is done.
+	// It returns descriptions of the work left queued.
+	Drain(ctx context.Context) []string
+}
+
+type task struct {
+	stage Stage
+	name  string
+}
+
+// Coordinator tracks in-flight work of writers, converters and uploaders,
+// and drives the shutdown sequence once it is stopped.
+type Coordinator struct {
+	ctx           context.Context
+	cancel        context.CancelFunc
+	gracePeriod   time.Duration
+	finishUploads bool
+
+	mu       sync.Mutex
+	stopping bool
+	nextId   uint64
+	tasks    map[uint64]task
+	changed  chan struct{}
+	drainers []Drainer
+	done     chan struct{}
+}
+
+func NewCoordinator(cfg *config.ShutdownConfig) *Coordinator {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Coordinator{
+		ctx:         ctx,
+		cancel:      cancel,
+		gracePeriod: defaultGracePeriod,
+		tasks:       make(map[uint64]task),
+		changed:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if cfg != nil {
+		if cfg.GracePeriod > 0 {
+			c.gracePeriod = cfg.GracePeriod
+		}
+		c.finishUploads = cfg.FinishUploads
+	}
+	return c
+}
+
+// Context is cancelled as soon as shutdown begins; no new recording should start after that.
+func (c *Coordinator) Context() context.Context {
+	return c.ctx
+}
+
+// Done is closed once the shutdown sequence has completed.
+func (c *Coordinator) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Coordinator) Stopping() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopping
+}
+
+// Register adds a drainer to be drained during shutdown, in registration order.
+func (c *Coordinator) Register(drainer Drainer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drainers = append(c.drainers, drainer)
+}
+
+// Begin records a piece of in-flight work; the returned func must be called once it is over.
+func (c *Coordinator) Begin(stage Stage, name string) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextId
+	c.nextId++
+	c.tasks[id] = task{stage, name}
+	c.notifyLocked()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			delete(c.tasks, id)
+			c.notifyLocked()
+		})
+	}
+}
+
+// Shutdown stops new work, lets writers flush, drains the registered stages and, if configured,
+// waits for in-flight uploads, all within the grace period. It logs a summary of what was left.
+func (c *Coordinator) Shutdown() {
+	c.mu.Lock()
+	if c.stopping {
+		c.mu.Unlock()
+		return
+	}
+	c.stopping = true
+	drainers := c.drainers
+	c.mu.Unlock()
+
+	log.Printf("Shutting down within %s.. \n", c.gracePeriod)
+	c.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.gracePeriod)
+	defer cancel()
+
+	c.waitFor(ctx, StageWriter)
+
+	var left []string
+	for _, drainer := range drainers {
+		left = append(left, drainer.Drain(ctx)...)
+	}
+
+	if c.finishUploads {
+		c.waitFor(ctx, StageUploader)
+	}
+	left = append(left, c.remaining()...)
+
+	if len(left) == 0 {
+		log.Println("Shutdown completed with nothing left queued")
+	} else {
+		log.Printf("Shutdown completed with %d item(s) left:", len(left))
+		for _, item := range left {
+			log.Printf("  - %s", item)
+		}
+	}
+	close(c.done)
+}
+
+// waitFor blocks until no work of the given stage is in flight or ctx is done.
+func (c *Coordinator) waitFor(ctx context.Context, stage Stage) {
+	for {
+		c.mu.Lock()
+		count := c.countLocked(stage)
+		changed := c.changed
+		c.mu.Unlock()
+
+		if count == 0 {
+			return
+		}
+		log.Printf("Waiting for %d %s(s) to finish", count, stage)
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Active returns the number of pieces of work of the given stage in flight.
+func (c *Coordinator) Active(stage Stage) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.countLocked(stage)
+}
+
+func (c *Coordinator) countLocked(stage Stage) int {
+	count := 0
+	for _, t := range c.tasks {
+		if t.stage == stage {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *Coordinator) remaining() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	left := make([]string, 0, len(c.tasks))
+	for _, t := range c.tasks {
+		left = append(left, fmt.Sprintf("unfinished %s: %s", t.stage, t.name))
+	}
+	sort.Strings(left)
+	return left
+}
+
+// notifyLocked wakes up everyone waiting for a change of in-flight work.
+func (c *Coordinator) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
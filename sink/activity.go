@@ -0,0 +1,241 @@
+package sink
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/hook"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/shutdown"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/uploader"
+)
+
+const maxRecentFailures = 50
+
+// Recording is a snapshot of a recording being written.
+type Recording struct {
+	Streamer     string    `json:"streamer"`
+	Title        string    `json:"title"`
+	MovieID      string    `json:"movie_id"`
+	IsMembership bool      `json:"is_membership"`
+	StartedAt    time.Time `json:"started_at"`
+	BytesWritten int64     `json:"bytes_written"`
+	FilePath     string    `json:"file_path"`
+}
+
+// Upload is an upload in progress or waiting for its upload window.
+type Upload struct {
+	Streamer  string    `json:"streamer"`
+	FilePath  string    `json:"file_path"`
+	RemoteKey string    `json:"remote_key"`
+	Resumed   bool      `json:"resumed"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Failure is a failed stage of a recording, kept among the recent failures.
+type Failure struct {
+	ID        uint64         `json:"id"`
+	Time      time.Time      `json:"time"`
+	Stage     shutdown.Stage `json:"stage"`
+	Streamer  string         `json:"streamer"`
+	FilePath  string         `json:"file_path,omitempty"`
+	RemoteKey string         `json:"remote_key,omitempty"`
+	Error     string         `json:"error"`
+	// Retryable tells that the failed work can be retried with Pipeline.Retry, which has not been done yet.
+	Retryable bool `json:"retryable"`
+
+	retry func() error
+}
+
+// activity tracks the recordings and uploads in progress and the recent failures, for the status API.
+type activity struct {
+	mu          sync.Mutex
+	recordings  map[*FileSink]struct{}
+	nextUpload  uint64
+	uploads     map[uint64]Upload
+	nextFailure uint64
+	failures    []Failure
+	// stoppedMovies are the movie IDs whose recording was stopped, so that they are not recorded again.
+	stoppedMovies map[string]bool
+}
+
+func newActivity() *activity {
+	return &activity{
+		recordings:    make(map[*FileSink]struct{}),
+		uploads:       make(map[uint64]Upload),
+		stoppedMovies: make(map[string]bool),
+	}
+}
+
+// recording tracks a file sink until the returned func is called.
+func (a *activity) recording(f *FileSink) func() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recordings[f] = struct{}{}
+	activeRecordings.Inc()
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.recordings, f)
+		activeRecordings.Dec()
+	}
+}
+
+// uploading tracks an upload until the returned func is called.
+func (a *activity) uploading(upload Upload) func() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := a.nextUpload
+	a.nextUpload++
+	upload.StartedAt = time.Now()
+	a.uploads[id] = upload
+	uploadQueueDepth.Inc()
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.uploads, id)
+		uploadQueueDepth.Dec()
+	}
+}
+
+// failed records a failure, which can be retried with retry if it is not nil.
+func (a *activity) failed(failure Failure, retry func() error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nextFailure++
+	failure.ID = a.nextFailure
+	failure.Time = time.Now()
+	failure.Retryable = retry != nil
+	failure.retry = retry
+	a.failures = append(a.failures, failure)
+	if len(a.failures) > maxRecentFailures {
+		a.failures = a.failures[len(a.failures)-maxRecentFailures:]
+	}
+}
+
+// Recordings returns the recordings being written, oldest first.
+func (p *Pipeline) Recordings() []Recording {
+	p.activity.mu.Lock()
+	defer p.activity.mu.Unlock()
+
+	recordings := make([]Recording, 0, len(p.activity.recordings))
+	for f := range p.activity.recordings {
+		recordings = append(recordings, f.snapshot())
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].StartedAt.Before(recordings[j].StartedAt) })
+	return recordings
+}
+
+// Uploads returns the uploads in progress, oldest first.
+func (p *Pipeline) Uploads() []Upload {
+	p.activity.mu.Lock()
+	defer p.activity.mu.Unlock()
+
+	uploads := make([]Upload, 0, len(p.activity.uploads))
+	for _, upload := range p.activity.uploads {
+		uploads = append(uploads, upload)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].StartedAt.Before(uploads[j].StartedAt) })
+	return uploads
+}
+
+// Failures returns the most recent failures, newest first.
+func (p *Pipeline) Failures() []Failure {
+	p.activity.mu.Lock()
+	defer p.activity.mu.Unlock()
+
+	failures := make([]Failure, len(p.activity.failures))
+	for i, failure := range p.activity.failures {
+		failures[len(failures)-1-i] = failure
+	}
+	return failures
+}
+
+// Retry retries the work of a recent failure; each failure can be retried once.
+func (p *Pipeline) Retry(id uint64) error {
+	p.activity.mu.Lock()
+	var retry func() error
+	for i := range p.activity.failures {
+		if failure := &p.activity.failures[i]; failure.ID == id {
+			retry = failure.retry
+			failure.retry, failure.Retryable = nil, false
+		}
+	}
+	p.activity.mu.Unlock()
+
+	if retry == nil {
+		return fmt.Errorf("failure %d cannot be retried", id)
+	}
+	return retry()
+}
+
+// StopRecordings stops the recordings of the given streamer, and keeps their live streams from being
+// recorded again. It returns the number of recordings stopped.
+func (p *Pipeline) StopRecordings(streamer string) int {
+	p.activity.mu.Lock()
+	defer p.activity.mu.Unlock()
+
+	stopped := 0
+	for f := range p.activity.recordings {
+		if f.recordCtx.GetStreamer() != streamer {
+			continue
+		}
+		if movieId := f.recordCtx.GetStreamMetadata().MovieId; movieId != "" {
+			p.activity.stoppedMovies[movieId] = true
+		}
+		log.Printf("Stopping recording %s", f.tsFilePath)
+		f.recordCtx.Cancel()
+		stopped++
+	}
+	return stopped
+}
+
+// stopped reports whether the live stream of recordCtx was stopped before.
+func (p *Pipeline) stopped(recordCtx ContextCanceller) bool {
+	movieId := recordCtx.GetStreamMetadata().MovieId
+	p.activity.mu.Lock()
+	defer p.activity.mu.Unlock()
+	return movieId != "" && p.activity.stoppedMovies[movieId]
+}
+
+// snapshot describes this recording as it is being written.
+func (f *FileSink) snapshot() Recording {
+	return Recording{
+		Streamer:     f.recordCtx.GetStreamer(),
+		Title:        f.recordCtx.GetStreamTitle(),
+		MovieID:      f.recordCtx.GetStreamMetadata().MovieId,
+		IsMembership: f.recordCtx.IsMembershipStream(),
+		StartedAt:    f.startedAt,
+		BytesWritten: f.written.Load(),
+		FilePath:     f.tsFilePath,
+	}
+}
+
+// failed records a failure of the given stage on a file of this recording, and runs the on-failure hooks.
+// Failed uploads and conversions can be retried.
+func (f *FileSink) failed(stage shutdown.Stage, filePath, remoteKey string, err error) {
+	var retry func() error
+	switch stage {
+	case shutdown.StageUploader:
+		retry = func() error {
+			f.uploadTo(filePath, uploader.FailedTargets(err))
+			return nil
+		}
+	case shutdown.StageConverter:
+		if job, ok := f.recordCtx.(*ConvertJob); ok {
+			retry = func() error {
+				return f.pipeline.queue.Retry(job.ID)
+			}
+		}
+	}
+	f.pipeline.activity.failed(Failure{
+		Stage:     stage,
+		Streamer:  f.recordCtx.GetStreamer(),
+		FilePath:  filePath,
+		RemoteKey: remoteKey,
+		Error:     err.Error(),
+	}, retry)
+	f.fireHook(hook.OnFailure, remoteKey, err)
+}
@@ -0,0 +1,208 @@
+package sink
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	defaultMemoryBufferBytes = 32 << 20
+	spillReadChunkBytes      = 256 << 10
+)
+
+// BufferStats reports how well the disk kept up with the network during a recording.
+type BufferStats struct {
+	ReceivedBytes         int64 `json:"received_bytes"`
+	WrittenBytes          int64 `json:"written_bytes"`
+	SpilledBytes          int64 `json:"spilled_bytes"`
+	DroppedBytes          int64 `json:"dropped_bytes"`
+	MemoryHighWaterBytes  int64 `json:"memory_high_water_bytes"`
+	SpillHighWaterBytes   int64 `json:"spill_high_water_bytes"`
+	PendingHighWaterBytes int64 `json:"pending_high_water_bytes"`
+}
+
+// spillBuffer is an unbounded FIFO of byte chunks between the network reader and the disk writer.
+// Chunks are kept in memory up to a limit; beyond that they are appended to a temp file,
+// so that pushing never waits for the recording file to be written.
+type spillBuffer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	memory      [][]byte
+	memoryBytes int64
+	memoryLimit int64
+
+	spillDir     string
+	spillPattern string
+	spillFile    *os.File
+	spillWrite   int64
+	spillRead    int64
+
+	closed    bool
+	discarded bool
+	stats     BufferStats
+}
+
+func newSpillBuffer(memoryLimit int64, spillDir, spillPattern string) *spillBuffer {
+	if memoryLimit <= 0 {
+		memoryLimit = defaultMemoryBufferBytes
+	}
+	b := &spillBuffer{
+		memoryLimit:  memoryLimit,
+		spillDir:     spillDir,
+		spillPattern: spillPattern,
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// push queues data without waiting for the writer. Data is only dropped if it can be neither
+// kept in memory nor spilled to disk.
+func (b *spillBuffer) push(data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := int64(len(data))
+	b.stats.ReceivedBytes += size
+	if b.discarded {
+		b.stats.DroppedBytes += size
+		return
+	}
+
+	// Once spilling, keep appending to the spill file until the writer catches up, to preserve order.
+	if b.spillRead == b.spillWrite && b.memoryBytes+size <= b.memoryLimit {
+		b.memory = append(b.memory, data)
+		b.memoryBytes += size
+		b.stats.MemoryHighWaterBytes = max(b.stats.MemoryHighWaterBytes, b.memoryBytes)
+	} else if err := b.spillLocked(data); err != nil {
+		log.Printf("Dropping %d bytes; failed to spill recording buffer to disk: %v", size, err)
+		b.stats.DroppedBytes += size
+		return
+	}
+
+	pending := b.memoryBytes + b.spillWrite - b.spillRead
+	b.stats.PendingHighWaterBytes = max(b.stats.PendingHighWaterBytes, pending)
+	b.cond.Signal()
+}
+
+func (b *spillBuffer) spillLocked(data []byte) error {
+	if b.spillFile == nil {
+		spillFile, err := os.CreateTemp(b.spillDir, b.spillPattern)
+		if err != nil {
+			return err
+		}
+		b.spillFile = spillFile
+	}
+	if b.spillRead == b.spillWrite {
+		log.Printf("Disk is falling behind; spilling recording buffer to %s", b.spillFile.Name())
+	}
+
+	if _, err := b.spillFile.WriteAt(data, b.spillWrite); err != nil {
+		return err
+	}
+	b.spillWrite += int64(len(data))
+	b.stats.SpilledBytes += int64(len(data))
+	b.stats.SpillHighWaterBytes = max(b.stats.SpillHighWaterBytes, b.spillWrite-b.spillRead)
+	return nil
+}
+
+// pop blocks until the next chunk is available, returning io.EOF once closed and fully drained.
+// It must only be called from a single writer goroutine.
+func (b *spillBuffer) pop() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		if len(b.memory) > 0 {
+			data := b.memory[0]
+			b.memory[0] = nil
+			b.memory = b.memory[1:]
+			b.memoryBytes -= int64(len(data))
+			return data, nil
+		}
+		if b.spillRead < b.spillWrite {
+			return b.readSpillLocked()
+		}
+		if b.closed {
+			return nil, io.EOF
+		}
+		b.cond.Wait()
+	}
+}
+
+// readSpillLocked reads the next chunk from the spill file. The lock is released while reading,
+// so that push may keep appending past the chunk being read.
+func (b *spillBuffer) readSpillLocked() ([]byte, error) {
+	spillFile, offset := b.spillFile, b.spillRead
+	data := make([]byte, min(spillReadChunkBytes, b.spillWrite-b.spillRead))
+
+	b.mu.Unlock()
+	n, err := spillFile.ReadAt(data, offset)
+	b.mu.Lock()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	b.spillRead += int64(n)
+
+	// Caught up; reuse the spill file from the start next time.
+	if b.spillRead == b.spillWrite {
+		b.spillRead, b.spillWrite = 0, 0
+		if err := b.spillFile.Truncate(0); err != nil {
+			log.Printf("Error truncating spill file %s: %v", b.spillFile.Name(), err)
+		}
+	}
+	return data[:n], nil
+}
+
+// written records bytes that reached the recording file.
+func (b *spillBuffer) written(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stats.WrittenBytes += int64(n)
+}
+
+// close marks the end of input; pop keeps returning queued data until drained.
+func (b *spillBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// discard drops all queued and future data, counting it as dropped, and removes the spill file.
+func (b *spillBuffer) discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.discarded = true
+	b.stats.DroppedBytes += b.memoryBytes + b.spillWrite - b.spillRead
+	b.memory, b.memoryBytes = nil, 0
+	b.spillRead, b.spillWrite = 0, 0
+	b.removeSpillLocked()
+}
+
+// release removes the spill file once the buffer is no longer used.
+func (b *spillBuffer) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeSpillLocked()
+}
+
+func (b *spillBuffer) removeSpillLocked() {
+	if b.spillFile == nil {
+		return
+	}
+	b.spillFile.Close()
+	if err := os.Remove(b.spillFile.Name()); err != nil {
+		log.Printf("Error removing spill file %s: %v", b.spillFile.Name(), err)
+	}
+	b.spillFile = nil
+}
+
+func (b *spillBuffer) getStats() BufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
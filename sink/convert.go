@@ -0,0 +1,185 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/hook"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/notify"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/shutdown"
+)
+
+const (
+	OutputMp4  = "mp4"
+	OutputM4a  = "m4a"
+	OutputBoth = "both"
+)
+
+func isFFmpegInstalled() bool {
+	ffmpegCmd := exec.Command("ffmpeg", "-version")
+	err := ffmpegCmd.Run()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && !exitErr.Success() {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FileSink) m4aFilePath() string {
+	return strings.TrimSuffix(f.videoFilePath, filepath.Ext(f.videoFilePath)) + ".m4a"
+}
+
+// convertAndUpload converts the recording into the configured outputs, uploads them and removes the source.
+func (f *FileSink) convertAndUpload(ctx context.Context) error {
+	source, err := probeFile(ctx, f.tsFilePath)
+	if err != nil {
+		log.Printf("Error probing %s: %v", f.tsFilePath, err)
+	}
+	outputs := f.outputFilePaths(source)
+
+	for _, outputPath := range outputs {
+		if err := f.convertTs(ctx, outputPath, f.outputArgs(outputPath, outputPath+".tmp")); err != nil {
+			if ctx.Err() != nil {
+				return err // Cancelled by shutdown; the queue keeps the job for the next start
+			}
+			conversionFailures.Inc()
+			f.failed(shutdown.StageConverter, f.tsFilePath, "", err)
+			f.notify(notify.ConvertFailed, f.tsFilePath, "", err)
+			return err // Conversion failed, so don't upload or remove
+		}
+	}
+
+	if f.pipeline.verifyOutputs {
+		if source == nil {
+			err = fmt.Errorf("verification failed: source %s could not be probed", f.tsFilePath)
+		} else {
+			err = f.verifyOutputs(ctx, outputs, source)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			conversionFailures.Inc()
+			f.failed(shutdown.StageConverter, f.tsFilePath, "", err)
+			f.notify(notify.ConvertFailed, f.tsFilePath, "", err)
+			return err // Keep the source, since the converted files may be broken
+		}
+	}
+	f.fireHook(hook.OnConvertDone, "", nil)
+
+	f.writeSidecars(outputs...)
+	for _, outputPath := range outputs {
+		f.upload(outputPath)
+	}
+	f.upload(f.infoFilePath())
+	f.upload(f.manifestFilePath())
+	// A raw capture still being uploaded, or held until uploads may start, is removed once its upload completes.
+	if !f.pipeline.uploads.removeAfterUpload(f.tsFilePath) {
+		_ = RemoveFile(f.tsFilePath)
+	}
+	return nil
+}
+
+// outputFilePaths returns the files to produce from the probed recording. Audio-only broadcasts
+// always produce an .m4a, since video encode options make no sense for them.
+func (f *FileSink) outputFilePaths(source *probeResult) []string {
+	if source == nil {
+		log.Printf("Assuming %s has video since it could not be probed", f.tsFilePath)
+	} else if source.VideoStreams == 0 {
+		log.Printf("%s has no video stream; converting as audio-only broadcast", f.tsFilePath)
+		return []string{f.m4aFilePath()}
+	}
+
+	switch f.recordCtx.GetOutput() {
+	case OutputM4a:
+		return []string{f.m4aFilePath()}
+	case OutputBoth:
+		return []string{f.videoFilePath, f.m4aFilePath()}
+	default:
+		return []string{f.videoFilePath}
+	}
+}
+
+// outputArgs builds the ffmpeg arguments producing the given output file, writing to tmpOutputPath.
+func (f *FileSink) outputArgs(outputPath, tmpOutputPath string) []string {
+	if outputPath == f.videoFilePath {
+		return f.videoArgs(tmpOutputPath)
+	}
+	return f.audioArgs(tmpOutputPath)
+}
+
+// videoArgs builds the ffmpeg arguments of the recording's encode profile, writing to tmpOutputPath.
+func (f *FileSink) videoArgs(tmpOutputPath string) []string {
+	profile := f.recordCtx.GetEncodeProfile()
+
+	args := []string{"-y"}
+	args = append(args, profile.InputArgs...)
+	args = append(args, "-i", f.tsFilePath, "-c:v", profile.VideoCodec)
+	args = append(args, profile.VideoArgs...)
+	args = append(args, "-c:a", profile.AudioCodec)
+	args = append(args, profile.AudioArgs...)
+	args = append(args, profile.OutputArgs...)
+	if profile.Faststart {
+		args = append(args, "-movflags", "+faststart")
+	}
+	args = append(args, f.metadataArgs()...)
+	return append(args, "-f", profile.Format(), tmpOutputPath)
+}
+
+// audioArgs builds the ffmpeg arguments copying the audio track alone into an m4a at tmpOutputPath.
+func (f *FileSink) audioArgs(tmpOutputPath string) []string {
+	args := []string{"-y", "-i", f.tsFilePath, "-vn", "-c:a", "copy"}
+	args = append(args, f.metadataArgs()...)
+	return append(args, "-f", "mp4", tmpOutputPath)
+}
+
+// convertTs runs ffmpeg with ffmpegArgs, which write to outputPath + ".tmp", and renames the result to outputPath.
+func (f *FileSink) convertTs(ctx context.Context, outputPath string, ffmpegArgs []string) error {
+	tmpOutputPath := outputPath + ".tmp"
+
+	log.Printf("Start Converting... ffmpeg args = %v", ffmpegArgs)
+
+	startedAt := time.Now()
+	err := runFFmpeg(ctx, ffmpegArgs, f.recordingDuration(), f.pipeline.convertTimeout)
+	if err != nil {
+		log.Printf("Error running ffmpeg command: %v", err)
+		// Clean up the temporary file if conversion fails
+		if removeErr := os.Remove(tmpOutputPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Printf("Error removing temporary file %s: %v", tmpOutputPath, removeErr)
+		}
+		return err
+	}
+
+	// Rename the temporary file to the final file name on success
+	if err := os.Rename(tmpOutputPath, outputPath); err != nil {
+		log.Printf("Error renaming temporary file %s to %s: %v", tmpOutputPath, outputPath, err)
+		return err
+	}
+
+	conversionDuration.WithLabelValues(strings.TrimPrefix(filepath.Ext(outputPath), ".")).Observe(time.Since(startedAt).Seconds())
+	log.Printf("Conversion to %s completed", outputPath)
+	return nil
+}
+
+// metadataArgs returns ffmpeg arguments tagging the output with the unsanitized stream details.
+func (f *FileSink) metadataArgs() []string {
+	metadata := f.recordCtx.GetStreamMetadata()
+	args := []string{
+		"-metadata", "title=" + metadata.Title,
+		"-metadata", "artist=" + f.recordCtx.GetStreamer(),
+		"-metadata", "comment=" + metadata.Description,
+		// MP4 has no dedicated URL tag that common players show, so the source URL goes to description.
+		"-metadata", "description=" + metadata.SourceUrl,
+	}
+	if !f.startedAt.IsZero() {
+		args = append(args, "-metadata", "date="+f.startedAt.Format(time.RFC3339))
+	}
+	return args
+}
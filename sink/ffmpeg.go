@@ -0,0 +1,152 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	stderrTailLines     = 20
+	progressLogInterval = 30 * time.Second
+	ffmpegKillWaitDelay = 5 * time.Second
+)
+
+// ffmpegProgress is one block of key=value pairs reported by ffmpeg's -progress output.
+type ffmpegProgress struct {
+	outTime time.Duration
+	speed   string
+	ended   bool
+}
+
+// runFFmpeg runs ffmpeg with the given arguments until it exits, ctx is cancelled or timeout elapses.
+// totalDuration is the expected media duration used to report percent done, if known.
+// On failure, the returned error carries the tail of ffmpeg's stderr.
+func runFFmpeg(ctx context.Context, args []string, totalDuration, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ffmpegArgs := append([]string{"-nostdin", "-nostats", "-progress", "pipe:1"}, args...)
+	ffmpegCmd := exec.CommandContext(ctx, "ffmpeg", ffmpegArgs...)
+	ffmpegCmd.WaitDelay = ffmpegKillWaitDelay
+
+	stderrTail := &lineTail{limit: stderrTailLines}
+	ffmpegCmd.Stderr = stderrTail
+	progressOut, err := ffmpegCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := ffmpegCmd.Start(); err != nil {
+		return err
+	}
+	logProgress(progressOut, totalDuration)
+	err = ffmpegCmd.Wait()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("ffmpeg killed after exceeding timeout %s", timeout)
+	} else if errors.Is(ctx.Err(), context.Canceled) {
+		err = fmt.Errorf("ffmpeg cancelled: %w", ctx.Err())
+	}
+	if err != nil {
+		log.Printf("ffmpeg failed: %v; last stderr output:\n%s", err, stderrTail)
+		return fmt.Errorf("%w: %s", err, stderrTail.last())
+	}
+	return nil
+}
+
+// logProgress consumes ffmpeg's -progress output and logs it periodically until the output is closed.
+func logProgress(progressOut io.Reader, totalDuration time.Duration) {
+	scanner := bufio.NewScanner(progressOut)
+	progress := ffmpegProgress{}
+	lastLogged := time.Now()
+
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				progress.outTime = time.Duration(us) * time.Microsecond
+			}
+		case "speed":
+			progress.speed = strings.TrimSpace(value)
+		case "progress":
+			progress.ended = value == "end"
+			if progress.ended || time.Since(lastLogged) >= progressLogInterval {
+				log.Printf("Converting... %s", progress.describe(totalDuration))
+				lastLogged = time.Now()
+			}
+		}
+	}
+}
+
+func (p ffmpegProgress) describe(totalDuration time.Duration) string {
+	done := p.outTime.Round(time.Second).String()
+	if totalDuration > 0 {
+		percent := float64(p.outTime) / float64(totalDuration) * 100
+		if percent > 100 {
+			percent = 100
+		}
+		done = fmt.Sprintf("%.1f%% (%s)", percent, done)
+	}
+	return fmt.Sprintf("%s done at speed %s", done, p.speed)
+}
+
+// lineTail keeps the last limit lines written to it.
+type lineTail struct {
+	mu      sync.Mutex
+	lines   []string
+	partial string
+	limit   int
+}
+
+func (t *lineTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	text := t.partial + strings.ReplaceAll(string(p), "\r", "\n")
+	lines := strings.Split(text, "\n")
+	t.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if line = strings.TrimSpace(line); line != "" {
+			t.lines = append(t.lines, line)
+		}
+	}
+	if len(t.lines) > t.limit {
+		t.lines = t.lines[len(t.lines)-t.limit:]
+	}
+	return len(p), nil
+}
+
+func (t *lineTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(append(t.lines, t.partial), "\n")
+}
+
+// last returns the last complete line, which usually holds ffmpeg's error message.
+func (t *lineTail) last() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.partial != "" {
+		return strings.TrimSpace(t.partial)
+	}
+	if len(t.lines) == 0 {
+		return "no stderr output"
+	}
+	return t.lines[len(t.lines)-1]
+}
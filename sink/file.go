@@ -1,15 +1,25 @@
 package sink
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/hook"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/notify"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/shutdown"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/types"
 	"github.com/jzhang046/croned-twitcasting-recorder-mp4/uploader"
 )
 
@@ -19,23 +29,29 @@ const (
 	baseRecordingPath = "./file"
 )
 
-var IsTerminating = false
-
 // ContextCanceller defines the interface for canceling a context
 // and providing stream-related information, used to break import cycle.
 type ContextCanceller interface {
 	Cancel()
 	GetStreamer() string
 	GetStreamTitle() string
-	GetEncodeOption() *string
+	GetEncodeProfile() *config.EncodeProfile
+	GetOutput() string
 	IsMembershipStream() bool
+	GetStreamMetadata() types.StreamMetadata
 }
 
 type FileSink struct {
-	tsFilePath  string
-	mp4FilePath string
-	uploader    uploader.Uploader
-	recordCtx   ContextCanceller
+	tsFilePath    string
+	videoFilePath string
+	pipeline      *Pipeline
+	recordCtx     ContextCanceller
+	startedAt     time.Time
+	endedAt       time.Time
+	bufferStats   *BufferStats
+	tsSize        int64
+	tsDigest      string
+	written       atomic.Int64
 }
 
 func sanitizePathString(input string) string {
@@ -65,8 +81,8 @@ func GetFilePaths(recordCtx ContextCanceller) (string, string, string) {
 
 	streamerRecordPath := fmt.Sprintf("%s/%s", baseRecordingPath, streamer)
 	tsFilePath := fmt.Sprintf("%s/%s.ts", streamerRecordPath, fileName)
-	mp4FilePath := fmt.Sprintf("%s/%s.mp4", streamerRecordPath, fileName)
-	return tsFilePath, mp4FilePath, streamerRecordPath
+	videoFilePath := fmt.Sprintf("%s/%s.%s", streamerRecordPath, fileName, recordCtx.GetEncodeProfile().Extension)
+	return tsFilePath, videoFilePath, streamerRecordPath
 }
 
 func CreateRecordingFolder(streamerRecordPath string) error {
@@ -88,8 +104,11 @@ func CreateRecordingFolder(streamerRecordPath string) error {
 	return nil
 }
 
-func NewFileSink(recordCtx ContextCanceller, uploader uploader.Uploader) (chan<- []byte, string, error) {
-	tsFilePath, mp4FilePath, streamerRecordPath := GetFilePaths(recordCtx)
+func NewFileSink(recordCtx ContextCanceller, pipeline *Pipeline) (chan<- []byte, string, error) {
+	if pipeline.stopped(recordCtx) {
+		return nil, "", fmt.Errorf("recording of live stream %s was stopped", recordCtx.GetStreamMetadata().MovieId)
+	}
+	tsFilePath, videoFilePath, streamerRecordPath := GetFilePaths(recordCtx)
 
 	err := CreateRecordingFolder(streamerRecordPath)
 	if err != nil {
@@ -97,10 +116,10 @@ func NewFileSink(recordCtx ContextCanceller, uploader uploader.Uploader) (chan<-
 	}
 
 	sink := &FileSink{
-		tsFilePath:  tsFilePath,
-		mp4FilePath: mp4FilePath,
-		uploader:    uploader,
-		recordCtx:   recordCtx,
+		tsFilePath:    tsFilePath,
+		videoFilePath: videoFilePath,
+		pipeline:      pipeline,
+		recordCtx:     recordCtx,
 	}
 
 	return sink.start(), tsFilePath, nil
@@ -111,117 +130,288 @@ func (f *FileSink) start() chan<- []byte {
 	file, err := os.OpenFile(f.tsFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
 	if err != nil {
 		log.Printf("Failed to open file %s: %v", f.tsFilePath, err)
+		f.failed(shutdown.StageWriter, f.tsFilePath, "", err)
 		f.recordCtx.Cancel()
 		return nil
 	}
 	log.Printf("Recording file %s", f.tsFilePath)
+	f.startedAt = time.Now()
+
+	// The digest is computed while writing; data already in the file from an earlier attempt is hashed first.
+	hasher := sha256.New()
+	var size int64
+	if existing, err := os.Open(f.tsFilePath); err == nil {
+		size, _ = io.Copy(hasher, existing)
+		existing.Close()
+	}
+	writer := io.MultiWriter(file, hasher)
+	f.fireHook(hook.OnRecordStart, "", nil)
+
+	// Uploaders supporting it upload the capture while it is written; the upload at the end completes it.
+	live := uploader.StartLive(f.pipeline.uploader, f.tsFilePath, f.remoteKey(f.tsFilePath), f.uploadMetadata(f.tsFilePath))
 
 	sinkChan := make(chan []byte, SinkChanBuffer)
+	buffer := newSpillBuffer(f.pipeline.memoryBuffer, f.pipeline.spillDir, filepath.Base(f.tsFilePath)+"-*.spill")
+	writerDone := f.pipeline.coordinator.Begin(shutdown.StageWriter, f.tsFilePath)
+	f.written.Store(size)
+	recordingDone := f.pipeline.activity.recording(f)
 
+	// Keep draining the channel so that the websocket reader never waits for the disk.
 	go func() {
-		defer file.Close()
 		for data := range sinkChan {
-			if _, err = file.Write(data); err != nil {
+			buffer.push(data)
+		}
+		buffer.close()
+	}()
+
+	go func() {
+		defer writerDone()
+		defer recordingDone()
+		defer file.Close()
+		defer buffer.release()
+		// Webhooks are only told about recordings once stream data arrives, not of connections that fail.
+		started := false
+		for {
+			data, err := buffer.pop()
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				_, err = writer.Write(data)
+			}
+			if err != nil {
 				log.Printf("Error writing recording file %s: %v\n", f.tsFilePath, err)
+				buffer.discard()
+				if live != nil {
+					live.Stop()
+				}
+				f.failed(shutdown.StageWriter, f.tsFilePath, "", err)
 				f.recordCtx.Cancel()
 				return
 			}
+			buffer.written(len(data))
+			if !started {
+				started = true
+				f.notify(notify.RecordStarted, f.tsFilePath, "", nil)
+			}
+			size += int64(len(data))
+			f.written.Store(size)
+			if live != nil {
+				live.Written(size)
+			}
+		}
+		if live != nil {
+			live.Stop()
 		}
 
+		stats := buffer.getStats()
+		f.bufferStats = &stats
+		log.Printf(
+			"Buffer stats of %s: received %d bytes, written %d, spilled %d, dropped %d, memory high-water %d, spill high-water %d",
+			f.tsFilePath, stats.ReceivedBytes, stats.WrittenBytes, stats.SpilledBytes, stats.DroppedBytes,
+			stats.MemoryHighWaterBytes, stats.SpillHighWaterBytes,
+		)
+		f.endedAt = time.Now()
+		f.tsSize, f.tsDigest = fileSize(f.tsFilePath), hex.EncodeToString(hasher.Sum(nil))
 		log.Printf("Completed writing all data to %s", f.tsFilePath)
-		f.uploadTS()
-
-		if !IsTerminating {
-			go f.convertAndUploadMP4()
+		f.fireHook(hook.OnRecordEnd, "", nil)
+		if started {
+			f.notify(notify.RecordEnded, f.tsFilePath, "", nil)
 		}
-
+		f.writeSidecars(f.tsFilePath)
+		f.upload(f.tsFilePath)
+		f.enqueueConversion()
 	}()
 
 	return sinkChan
 }
 
-func (f *FileSink) uploadTS() {
-	if f.uploader != nil {
+// upload sends the given local file to the uploader in the background, if one is configured and takes the file.
+func (f *FileSink) upload(filePath string) {
+	f.uploadTo(filePath, nil)
+}
+
+// uploadTo uploads the given file to the named targets only, or to all accepting targets if none are named.
+func (f *FileSink) uploadTo(filePath string, targets []string) {
+	metadata := f.uploadMetadata(filePath)
+	metadata.Targets = targets
+	if uploader.Accepts(f.pipeline.uploader, metadata) {
+		remotePath := f.remoteKey(filePath)
+		uploadDone := f.pipeline.coordinator.Begin(shutdown.StageUploader, filePath)
+		uploadTracked := f.pipeline.activity.uploading(Upload{Streamer: metadata.Streamer, FilePath: filePath, RemoteKey: remotePath})
+		f.pipeline.uploads.add(pendingUpload{FilePath: filePath, RemoteKey: remotePath, Metadata: metadata})
 		go func() {
-			streamer := sanitizePathString(f.recordCtx.GetStreamer())
-			remotePath := streamer + "-" + filepath.Base(f.tsFilePath) // Updated remotePath construction
-			if err := f.uploader.Upload(f.tsFilePath, remotePath); err != nil {
-				log.Printf("TS upload failed for %s: %v", f.tsFilePath, err)
+			defer uploadDone()
+			defer uploadTracked()
+			if err := f.pipeline.uploader.Upload(filePath, remotePath, metadata); err != nil {
+				f.pipeline.uploads.retryTargets(filePath, uploader.FailedTargets(err))
+				if errors.Is(err, uploader.ErrUploadHeld) {
+					return
+				}
+				log.Printf("Upload failed for %s: %v", filePath, err)
+				f.failed(shutdown.StageUploader, filePath, remotePath, err)
+				return
+			}
+			removeFile := f.pipeline.uploads.remove(filePath)
+			f.fireHook(hook.OnUploadDone, remotePath, nil)
+			f.notify(notify.UploadDone, filePath, remotePath, nil)
+			if removeFile {
+				_ = RemoveFile(filePath)
+			} else if uploader.DeletesAfterUpload(f.pipeline.uploader, metadata) && !f.neededLocally(filePath) {
+				if err := f.pipeline.removeUploaded(filePath, remotePath, metadata); err != nil {
+					log.Println(err)
+					f.failed(shutdown.StageUploader, filePath, remotePath, err)
+				}
 			}
 		}()
 	}
 }
 
-func (f *FileSink) convertAndUploadMP4() {
-	if isFFmpegInstalled() {
-		err := f.convertTsToMp4()
-		if err != nil {
-			return // Conversion failed, so don't upload or remove
-		}
+// neededLocally reports whether a later stage still reads the file: the raw capture is kept for conversion,
+// which removes it once done.
+func (f *FileSink) neededLocally(filePath string) bool {
+	return filePath == f.tsFilePath && isFFmpegInstalled()
+}
 
-		if f.uploader != nil {
-			go func() {
-				streamer := sanitizePathString(f.recordCtx.GetStreamer())
-				remotePath := streamer + "-" + filepath.Base(f.mp4FilePath) // Updated remotePath construction
-				if err := f.uploader.Upload(f.mp4FilePath, remotePath); err != nil {
-					log.Printf("MP4 upload failed for %s: %v", f.mp4FilePath, err)
-				}
-			}()
-		}
-		_ = RemoveFile(f.tsFilePath)
-	} else {
-		log.Printf("ffmpeg is not installed, skipping conversion to mp4\n")
+// remoteKey returns the object key the given local file is uploaded to, laid out by the key template.
+// Dates are those of the recording start, so that all files of a recording end up together.
+func (f *FileSink) remoteKey(filePath string) string {
+	startedAt := f.startedAt
+	if startedAt.IsZero() {
+		startedAt = time.Now()
 	}
+	key := config.ExpandKeyTemplate(f.pipeline.keyTemplate, map[string]string{
+		"streamer": sanitizePathString(f.recordCtx.GetStreamer()),
+		"title":    sanitizePathString(f.recordCtx.GetStreamTitle()),
+		"movie_id": f.recordCtx.GetStreamMetadata().MovieId,
+		"yyyy":     startedAt.Format("2006"),
+		"mm":       startedAt.Format("01"),
+		"dd":       startedAt.Format("02"),
+		"hh":       startedAt.Format("15"),
+		"basename": filepath.Base(filePath),
+	})
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
 }
 
-func isFFmpegInstalled() bool {
-	ffmpegCmd := exec.Command("ffmpeg", "-version")
-	err := ffmpegCmd.Run()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok && !exitErr.Success() {
-			return false
-		}
+// uploadMetadata describes the given file of this recording for the uploaded objects, with its unsanitized title.
+func (f *FileSink) uploadMetadata(filePath string) uploader.Metadata {
+	title := f.recordCtx.GetStreamMetadata().Title
+	if title == "" {
+		title = f.recordCtx.GetStreamTitle()
+	}
+	return uploader.Metadata{
+		Streamer:     f.recordCtx.GetStreamer(),
+		Title:        title,
+		MovieID:      f.recordCtx.GetStreamMetadata().MovieId,
+		StartedAt:    f.startedAt,
+		IsMembership: f.recordCtx.IsMembershipStream(),
+		Artifact:     f.artifact(filePath),
 	}
-	return true
 }
 
-func (f *FileSink) convertTsToMp4() error {
-	encodeOption := f.recordCtx.GetEncodeOption()
-	if encodeOption == nil {
-		defaultOption := "copy"
-		encodeOption = &defaultOption
+// artifact tells the type of the given file of this recording.
+func (f *FileSink) artifact(filePath string) string {
+	switch filePath {
+	case f.tsFilePath:
+		return uploader.ArtifactRaw
+	case f.infoFilePath(), f.manifestFilePath():
+		return uploader.ArtifactSidecars
 	}
+	return uploader.ArtifactVideo
+}
 
-	encodeOptions := strings.Fields(*encodeOption)
-
-	tmpMp4FilePath := f.mp4FilePath + ".tmp"
+// writeSidecars refreshes the info file, then records it and the given files in the manifest.
+func (f *FileSink) writeSidecars(filePaths ...string) {
+	if err := f.writeInfo(); err != nil {
+		log.Printf("Error writing recording info %s: %v", f.infoFilePath(), err)
+	}
+	if err := f.updateManifest(append(filePaths, f.infoFilePath())...); err != nil {
+		log.Printf("Error writing manifest %s: %v", f.manifestFilePath(), err)
+	}
+}
 
-	ffmpegArgs := []string{"-i", f.tsFilePath, "-c:v"}
-	ffmpegArgs = append(ffmpegArgs, encodeOptions...)
-	ffmpegArgs = append(ffmpegArgs, "-c:a", "copy", "-f", "mp4", tmpMp4FilePath)
+// enqueueConversion hands the finished recording over to the conversion queue.
+func (f *FileSink) enqueueConversion() {
+	if !isFFmpegInstalled() {
+		log.Printf("ffmpeg is not installed, skipping conversion\n")
+		f.upload(f.infoFilePath())
+		f.upload(f.manifestFilePath())
+		return
+	}
 
-	log.Printf("Start Converting... ffmpeg args = %v", ffmpegArgs)
+	f.pipeline.queue.Enqueue(&ConvertJob{
+		Streamer:      f.recordCtx.GetStreamer(),
+		StreamTitle:   f.recordCtx.GetStreamTitle(),
+		IsMembership:  f.recordCtx.IsMembershipStream(),
+		EncodeProfile: f.recordCtx.GetEncodeProfile(),
+		Output:        f.recordCtx.GetOutput(),
+		Metadata:      f.recordCtx.GetStreamMetadata(),
+		TsFilePath:    f.tsFilePath,
+		VideoFilePath: f.videoFilePath,
+		StartedAt:     f.startedAt,
+		EndedAt:       f.endedAt,
+	})
+}
 
-	ffmpegCmd := exec.Command("ffmpeg", ffmpegArgs...)
+// fireHook runs the hooks of the given event with the current state of this recording.
+func (f *FileSink) fireHook(event hook.Event, remoteKey string, err error) {
+	payload := hook.Payload{
+		Event:         event,
+		Streamer:      f.recordCtx.GetStreamer(),
+		Title:         f.recordCtx.GetStreamTitle(),
+		IsMembership:  f.recordCtx.IsMembershipStream(),
+		TsFilePath:    f.tsFilePath,
+		TsFileSize:    fileSize(f.tsFilePath),
+		VideoFilePath: f.videoFilePath,
+		VideoFileSize: fileSize(f.videoFilePath),
+		M4aFilePath:   f.m4aFilePath(),
+		M4aFileSize:   fileSize(f.m4aFilePath()),
+		Mp4FilePath:   f.videoFilePath,
+		Mp4FileSize:   fileSize(f.videoFilePath),
+		RemoteKey:     remoteKey,
+	}
+	payload.DurationSeconds = f.recordingDuration().Seconds()
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	f.pipeline.hooks.Fire(payload)
+}
 
-	err := ffmpegCmd.Run()
+// notify sends the given event of this recording, about the given file, to the webhooks.
+func (f *FileSink) notify(event notify.Event, filePath, remoteKey string, err error) {
+	metadata := f.uploadMetadata(filePath)
+	notification := notify.Notification{
+		Event:           event,
+		Streamer:        metadata.Streamer,
+		Title:           metadata.Title,
+		MovieID:         metadata.MovieID,
+		URL:             f.recordCtx.GetStreamMetadata().SourceUrl,
+		IsMembership:    metadata.IsMembership,
+		FilePath:        filePath,
+		Size:            fileSize(filePath),
+		DurationSeconds: f.recordingDuration().Seconds(),
+		RemoteKey:       remoteKey,
+	}
 	if err != nil {
-		log.Printf("Error running ffmpeg command: %v", err)
-		// Clean up the temporary file if conversion fails
-		if removeErr := os.Remove(tmpMp4FilePath); removeErr != nil && !os.IsNotExist(removeErr) {
-			log.Printf("Error removing temporary file %s: %v", tmpMp4FilePath, removeErr)
-		}
-		return err
+		notification.Error = err.Error()
 	}
+	f.pipeline.notifier.Notify(notification)
+}
 
-	// Rename the temporary file to the final file name on success
-	if err := os.Rename(tmpMp4FilePath, f.mp4FilePath); err != nil {
-		log.Printf("Error renaming temporary file %s to %s: %v", tmpMp4FilePath, f.mp4FilePath, err)
-		return err
+// recordingDuration returns the wall-clock length of the recording, or zero while it is still running.
+func (f *FileSink) recordingDuration() time.Duration {
+	if f.startedAt.IsZero() || f.endedAt.IsZero() {
+		return 0
 	}
+	return f.endedAt.Sub(f.startedAt)
+}
 
-	log.Printf("Conversion to %s completed", f.mp4FilePath)
-	return nil
+func fileSize(filePath string) int64 {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return 0
+	}
+	return fileInfo.Size()
 }
 
 func RemoveFile(filename string) error {
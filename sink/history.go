@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FinishedRecording is a recording done writing, as described by its info file, with its files still kept locally.
+type FinishedRecording struct {
+	RecordingInfo
+	LocalFiles []LocalFile `json:"local_files"`
+}
+
+// LocalFile is a file in the recording folder; Path is relative to the folder, with forward slashes.
+type LocalFile struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// History returns up to limit finished recordings found in the recording folder, newest first.
+func (p *Pipeline) History(limit int) ([]FinishedRecording, error) {
+	infoPaths, err := filepath.Glob(filepath.Join(baseRecordingPath, "*", "*"+infoFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	recording := make(map[string]bool)
+	for _, active := range p.Recordings() {
+		recording[filepath.Base(active.FilePath)] = true
+	}
+
+	history := []FinishedRecording{}
+	for _, infoPath := range infoPaths {
+		data, err := os.ReadFile(infoPath)
+		if err != nil {
+			continue
+		}
+		finished := FinishedRecording{LocalFiles: []LocalFile{}}
+		if err := json.Unmarshal(data, &finished.RecordingInfo); err != nil || recording[finished.TsFile] {
+			continue
+		}
+		streamerDir := filepath.Base(filepath.Dir(infoPath))
+		for _, name := range []string{finished.TsFile, finished.VideoFile, finished.M4aFile} {
+			if name == "" {
+				continue
+			}
+			if size := fileSize(filepath.Join(filepath.Dir(infoPath), name)); size > 0 {
+				finished.LocalFiles = append(finished.LocalFiles, LocalFile{
+					Name: name,
+					Path: path.Join(streamerDir, name),
+					Size: size,
+				})
+			}
+		}
+		history = append(history, finished)
+	}
+
+	sort.Slice(history, func(i, j int) bool { return history[i].StartedAt.After(history[j].StartedAt) })
+	if limit > 0 && len(history) > limit {
+		history = history[:limit]
+	}
+	return history, nil
+}
+
+// RecordingFiles gives read access to the recordings in the recording folder. Hidden files, such as
+// the queue and upload state files, and anything outside of the streamer folders are left out.
+func RecordingFiles() fs.FS {
+	return recordingFS{os.DirFS(baseRecordingPath)}
+}
+
+type recordingFS struct {
+	fs.FS
+}
+
+func (r recordingFS) Open(name string) (fs.File, error) {
+	elements := strings.Split(name, "/")
+	if !fs.ValidPath(name) || len(elements) != 2 || strings.HasPrefix(elements[0], ".") || strings.HasPrefix(elements[1], ".") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return r.FS.Open(name)
+}
@@ -0,0 +1,77 @@
+package sink
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+const infoFileSuffix = ".info.json"
+
+// RecordingInfo is written next to each recording as a sidecar, keeping the details
+// that do not survive filename sanitization.
+type RecordingInfo struct {
+	Streamer      string                `json:"streamer"`
+	Title         string                `json:"title"`
+	Description   string                `json:"description"`
+	MovieId       string                `json:"movie_id"`
+	SourceUrl     string                `json:"source_url"`
+	IsMembership  bool                  `json:"is_membership"`
+	StartedAt     time.Time             `json:"started_at"`
+	EndedAt       time.Time             `json:"ended_at"`
+	TsFile        string                `json:"ts_file"`
+	TsBytes       int64                 `json:"ts_bytes"`
+	VideoFile     string                `json:"video_file,omitempty"`
+	VideoBytes    int64                 `json:"video_bytes,omitempty"`
+	M4aFile       string                `json:"m4a_file,omitempty"`
+	M4aBytes      int64                 `json:"m4a_bytes,omitempty"`
+	EncodeProfile *config.EncodeProfile `json:"encode_profile"`
+	BufferStats   *BufferStats          `json:"buffer_stats,omitempty"`
+}
+
+func (f *FileSink) infoFilePath() string {
+	return strings.TrimSuffix(f.tsFilePath, filepath.Ext(f.tsFilePath)) + infoFileSuffix
+}
+
+// writeInfo writes the sidecar of this recording, updating the previous version if any.
+func (f *FileSink) writeInfo() error {
+	info := RecordingInfo{}
+	// Details only known while recording, such as buffer stats, are kept from the previous version.
+	if data, err := os.ReadFile(f.infoFilePath()); err == nil {
+		_ = json.Unmarshal(data, &info)
+	}
+
+	metadata := f.recordCtx.GetStreamMetadata()
+	info.Streamer = f.recordCtx.GetStreamer()
+	info.Title = metadata.Title
+	info.Description = metadata.Description
+	info.MovieId = metadata.MovieId
+	info.SourceUrl = metadata.SourceUrl
+	info.IsMembership = f.recordCtx.IsMembershipStream()
+	info.StartedAt = f.startedAt
+	info.EndedAt = f.endedAt
+	info.TsFile = filepath.Base(f.tsFilePath)
+	info.TsBytes = fileSize(f.tsFilePath)
+	info.EncodeProfile = f.recordCtx.GetEncodeProfile()
+	if f.bufferStats != nil {
+		info.BufferStats = f.bufferStats
+	}
+	if videoBytes := fileSize(f.videoFilePath); videoBytes > 0 {
+		info.VideoFile = filepath.Base(f.videoFilePath)
+		info.VideoBytes = videoBytes
+	}
+	if m4aBytes := fileSize(f.m4aFilePath()); m4aBytes > 0 {
+		info.M4aFile = filepath.Base(f.m4aFilePath())
+		info.M4aBytes = m4aBytes
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.infoFilePath(), data, 0664)
+}
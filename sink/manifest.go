@@ -0,0 +1,106 @@
+package sink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const manifestFileSuffix = ".manifest.json"
+
+// ManifestEntry describes one file produced for a recording.
+type ManifestEntry struct {
+	File      string `json:"file"`
+	RemoteKey string `json:"remote_key,omitempty"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+}
+
+// Manifest lists every file produced for a recording, so that an archive can be checked for completeness.
+type Manifest struct {
+	Streamer  string          `json:"streamer"`
+	StartedAt time.Time       `json:"started_at"`
+	Files     []ManifestEntry `json:"files"`
+}
+
+func ReadManifest(manifestPath string) (*Manifest, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// HashFile returns the size and hex-encoded SHA-256 of the given file.
+func HashFile(filePath string) (int64, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	return HashReader(file)
+}
+
+func HashReader(reader io.Reader) (int64, string, error) {
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, reader)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (f *FileSink) manifestFilePath() string {
+	return strings.TrimSuffix(f.tsFilePath, filepath.Ext(f.tsFilePath)) + manifestFileSuffix
+}
+
+// updateManifest adds or refreshes the entries of the given files in this recording's manifest.
+// The raw capture uses the digest computed while writing it, so it is never read again.
+func (f *FileSink) updateManifest(filePaths ...string) error {
+	manifest, err := ReadManifest(f.manifestFilePath())
+	if os.IsNotExist(err) {
+		manifest = &Manifest{}
+	} else if err != nil {
+		return err
+	}
+	manifest.Streamer = f.recordCtx.GetStreamer()
+	manifest.StartedAt = f.startedAt
+
+	for _, filePath := range filePaths {
+		entry := ManifestEntry{
+			File:      filepath.Base(filePath),
+			RemoteKey: f.remoteKey(filePath),
+		}
+		if filePath == f.tsFilePath && f.tsDigest != "" {
+			entry.Size, entry.SHA256 = f.tsSize, f.tsDigest
+		} else if entry.Size, entry.SHA256, err = HashFile(filePath); err != nil {
+			return err
+		}
+		manifest.upsert(entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.manifestFilePath(), data, 0664)
+}
+
+func (m *Manifest) upsert(entry ManifestEntry) {
+	for i := range m.Files {
+		if m.Files[i].File == entry.File {
+			m.Files[i] = entry
+			return
+		}
+	}
+	m.Files = append(m.Files, entry)
+}
@@ -0,0 +1,33 @@
+package sink
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// durationBuckets are histogram buckets in seconds, for work taking from seconds to hours.
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+var (
+	activeRecordings = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "twitcasting_recorder_active_recordings",
+		Help: "Recordings being written.",
+	})
+	conversionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "twitcasting_recorder_conversion_duration_seconds",
+		Help:    "Duration of successful ffmpeg conversions, by output file type.",
+		Buckets: durationBuckets,
+	}, []string{"output"})
+	conversionFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "twitcasting_recorder_conversion_failures_total",
+		Help: "Conversions that failed or whose outputs failed verification.",
+	})
+	conversionQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "twitcasting_recorder_conversion_queue_depth",
+		Help: "Conversions waiting in the queue or running, by status.",
+	}, []string{"status"})
+	uploadQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "twitcasting_recorder_upload_queue_depth",
+		Help: "Uploads in progress or held until they may start.",
+	})
+)
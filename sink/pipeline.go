@@ -0,0 +1,191 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/hook"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/notify"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/shutdown"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/uploader"
+)
+
+// Pipeline holds the post-recording stages shared by all file sinks.
+type Pipeline struct {
+	uploader          uploader.Uploader
+	hooks             *hook.Runner
+	notifier          *notify.Notifier
+	queue             *ConvertQueue
+	coordinator       *shutdown.Coordinator
+	convertTimeout    time.Duration
+	verifyOutputs     bool
+	durationTolerance time.Duration
+	memoryBuffer      int64
+	spillDir          string
+	keyTemplate       string
+	activity          *activity
+	uploads           *uploadJournal
+}
+
+func NewPipeline(cfg *config.Config, uploader uploader.Uploader, hooks *hook.Runner, notifier *notify.Notifier, coordinator *shutdown.Coordinator) *Pipeline {
+	p := &Pipeline{
+		uploader:          uploader,
+		hooks:             hooks,
+		notifier:          notifier,
+		queue:             NewConvertQueue(cfg.Convert, coordinator),
+		coordinator:       coordinator,
+		verifyOutputs:     true,
+		durationTolerance: defaultDurationTolerance,
+		keyTemplate:       config.DefaultKeyTemplate,
+		activity:          newActivity(),
+	}
+	pendingUploadsFile := defaultPendingUploadsFile
+	if cfg.Upload != nil {
+		if cfg.Upload.KeyTemplate != "" {
+			p.keyTemplate = cfg.Upload.KeyTemplate
+		}
+		if cfg.Upload.PendingFile != "" {
+			pendingUploadsFile = cfg.Upload.PendingFile
+		}
+	}
+	p.uploads = loadUploadJournal(pendingUploadsFile)
+	if cfg.Convert != nil {
+		p.convertTimeout = cfg.Convert.Timeout
+		p.verifyOutputs = !cfg.Convert.SkipVerify
+		if cfg.Convert.DurationTolerance > 0 {
+			p.durationTolerance = cfg.Convert.DurationTolerance
+		}
+	}
+	if cfg.Sink != nil {
+		p.memoryBuffer = int64(cfg.Sink.MemoryBufferMB) << 20
+		p.spillDir = cfg.Sink.SpillDir
+	}
+	coordinator.Register(p.queue)
+	return p
+}
+
+// Start resumes persisted conversions and unfinished uploads, and starts accepting new ones.
+func (p *Pipeline) Start() {
+	p.queue.Start(p.convert)
+	go p.resumeUploads()
+}
+
+// resumeUploads retries the uploads left unfinished by the previous run. Uploaders keeping their own progress
+// first clean up partial uploads that cannot be resumed; theirs are only retried if not pending already.
+func (p *Pipeline) resumeUploads() {
+	resumer, _ := p.uploader.(uploader.Resumer)
+	if resumer != nil {
+		if err := resumer.AbortOrphans(); err != nil {
+			log.Printf("Failed to clean up orphaned uploads: %v", err)
+		}
+	}
+	for _, pending := range p.uploads.snapshot() {
+		if _, err := os.Stat(pending.FilePath); err != nil || !uploader.Accepts(p.uploader, pending.Metadata) {
+			log.Printf("Dropping unfinished upload of %s; the file is gone or no upload target takes it", pending.FilePath)
+			p.uploads.remove(pending.FilePath)
+			continue
+		}
+		p.resumeUpload(uploader.PendingUpload{
+			FilePath:   pending.FilePath,
+			RemotePath: pending.RemoteKey,
+			Metadata:   pending.Metadata,
+			Uploader:   p.uploader,
+		})
+	}
+	if resumer != nil {
+		for _, pending := range resumer.Interrupted() {
+			if !p.uploads.has(pending.FilePath) {
+				p.resumeUpload(pending)
+			}
+		}
+	}
+}
+
+// resumeUpload retries an interrupted upload in the background.
+func (p *Pipeline) resumeUpload(pending uploader.PendingUpload) {
+	uploadDone := p.coordinator.Begin(shutdown.StageUploader, pending.FilePath)
+	uploadTracked := p.activity.uploading(Upload{
+		Streamer:  pending.Metadata.Streamer,
+		FilePath:  pending.FilePath,
+		RemoteKey: pending.RemotePath,
+		Resumed:   true,
+	})
+	failed := func(err error) {
+		if targets := uploader.FailedTargets(err); targets != nil {
+			pending.Metadata.Targets = targets
+		}
+		p.activity.failed(Failure{
+			Stage:     shutdown.StageUploader,
+			Streamer:  pending.Metadata.Streamer,
+			FilePath:  pending.FilePath,
+			RemoteKey: pending.RemotePath,
+			Error:     err.Error(),
+		}, func() error {
+			p.resumeUpload(pending)
+			return nil
+		})
+	}
+	go func() {
+		defer uploadDone()
+		defer uploadTracked()
+		log.Printf("Resuming interrupted upload of %s", pending.FilePath)
+		if err := pending.Uploader.Upload(pending.FilePath, pending.RemotePath, pending.Metadata); err != nil {
+			p.uploads.retryTargets(pending.FilePath, uploader.FailedTargets(err))
+			if errors.Is(err, uploader.ErrUploadHeld) {
+				return
+			}
+			log.Printf("Upload failed for %s: %v", pending.FilePath, err)
+			failed(err)
+			return
+		}
+		removeFile := p.uploads.remove(pending.FilePath)
+		p.notifier.Notify(notify.Notification{
+			Event:        notify.UploadDone,
+			Streamer:     pending.Metadata.Streamer,
+			Title:        pending.Metadata.Title,
+			MovieID:      pending.Metadata.MovieID,
+			IsMembership: pending.Metadata.IsMembership,
+			FilePath:     pending.FilePath,
+			Size:         fileSize(pending.FilePath),
+			RemoteKey:    pending.RemotePath,
+		})
+		if removeFile {
+			_ = RemoveFile(pending.FilePath)
+		} else if uploader.DeletesAfterUpload(p.uploader, pending.Metadata) && !p.queue.pending(pending.FilePath) {
+			if err := p.removeUploaded(pending.FilePath, pending.RemotePath, pending.Metadata); err != nil {
+				log.Println(err)
+				failed(err)
+			}
+		}
+	}()
+}
+
+// removeUploaded removes a local file once the uploader confirms that every uploaded copy matches it.
+// The file is kept if the upload cannot be verified.
+func (p *Pipeline) removeUploaded(filePath, remotePath string, metadata uploader.Metadata) error {
+	if err := uploader.VerifyUpload(p.uploader, filePath, remotePath, metadata); err != nil {
+		return fmt.Errorf("keeping %s; failed to verify upload: %w", filePath, err)
+	}
+	return RemoveFile(filePath)
+}
+
+func (p *Pipeline) ConvertQueue() *ConvertQueue {
+	return p.queue
+}
+
+func (p *Pipeline) convert(ctx context.Context, job *ConvertJob) error {
+	f := &FileSink{
+		tsFilePath:    job.TsFilePath,
+		videoFilePath: job.VideoFilePath,
+		pipeline:      p,
+		recordCtx:     job,
+		startedAt:     job.StartedAt,
+		endedAt:       job.EndedAt,
+	}
+	return f.convertAndUpload(ctx)
+}
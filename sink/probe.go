@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// probeResult is the part of ffprobe's output the conversion stages care about.
+type probeResult struct {
+	Duration     time.Duration
+	VideoStreams int
+	AudioStreams int
+}
+
+func probeFile(ctx context.Context, filePath string) (*probeResult, error) {
+	output, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration:stream=codec_type",
+		"-of", "json",
+		filePath,
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var probed struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &probed); err != nil {
+		return nil, err
+	}
+
+	result := &probeResult{}
+	if seconds, err := strconv.ParseFloat(probed.Format.Duration, 64); err == nil {
+		result.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	for _, stream := range probed.Streams {
+		switch stream.CodecType {
+		case "video":
+			result.VideoStreams++
+		case "audio":
+			result.AudioStreams++
+		}
+	}
+	return result, nil
+}
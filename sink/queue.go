@@ -0,0 +1,408 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/shutdown"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/types"
+)
+
+const (
+	defaultConvertConcurrency = 1
+	defaultQueueFile          = baseRecordingPath + "/.convert-queue.json"
+	ShutdownFinish            = "finish"
+	ShutdownCancel            = "cancel"
+	maxFinishedJobs           = 100
+)
+
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// ConvertJob carries everything needed to convert a finished recording,
+// so that it can be resumed after a restart without its original record context.
+type ConvertJob struct {
+	ID            string                `json:"id"`
+	Streamer      string                `json:"streamer"`
+	StreamTitle   string                `json:"stream_title"`
+	IsMembership  bool                  `json:"is_membership"`
+	EncodeProfile *config.EncodeProfile `json:"encode_profile"`
+	Output        string                `json:"output,omitempty"`
+	Metadata      types.StreamMetadata  `json:"metadata"`
+	TsFilePath    string                `json:"ts_file_path"`
+	VideoFilePath string                `json:"video_file_path"`
+	StartedAt     time.Time             `json:"started_at"`
+	EndedAt       time.Time             `json:"ended_at"`
+	Status        JobStatus             `json:"status"`
+	Error         string                `json:"error,omitempty"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+
+	// Queues written before encode profiles hold these instead; they are migrated on load.
+	LegacyEncodeOption *string `json:"encode_option,omitempty"`
+	LegacyMp4FilePath  string  `json:"mp4_file_path,omitempty"`
+}
+
+// migrate fills in the fields of a job persisted by an older version.
+func (job *ConvertJob) migrate() {
+	if job.VideoFilePath == "" {
+		job.VideoFilePath = job.LegacyMp4FilePath
+	}
+	if job.EncodeProfile == nil {
+		encodeOption := ""
+		if job.LegacyEncodeOption != nil {
+			encodeOption = *job.LegacyEncodeOption
+		}
+		job.EncodeProfile = config.EncodeProfileFromOption(encodeOption)
+	}
+	job.LegacyEncodeOption, job.LegacyMp4FilePath = nil, ""
+}
+
+// ConvertJob satisfies ContextCanceller so that the conversion stages can treat it like a live recording.
+
+func (job *ConvertJob) Cancel()                                 {}
+func (job *ConvertJob) GetStreamer() string                     { return job.Streamer }
+func (job *ConvertJob) GetStreamTitle() string                  { return job.StreamTitle }
+func (job *ConvertJob) GetEncodeProfile() *config.EncodeProfile { return job.EncodeProfile }
+func (job *ConvertJob) GetOutput() string                       { return job.Output }
+func (job *ConvertJob) IsMembershipStream() bool                { return job.IsMembership }
+func (job *ConvertJob) GetStreamMetadata() types.StreamMetadata { return job.Metadata }
+
+// ConvertQueue runs conversion jobs on a bounded number of workers.
+// Unfinished jobs are persisted to disk and picked up again on the next start.
+type ConvertQueue struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	jobs        []*ConvertJob
+	queueFile   string
+	concurrency int
+	onShutdown  string
+	running     int
+	stopped     bool
+	coordinator *shutdown.Coordinator
+	ctx         context.Context
+	cancel      context.CancelFunc
+	handler     func(context.Context, *ConvertJob) error
+}
+
+func NewConvertQueue(cfg *config.ConvertConfig, coordinator *shutdown.Coordinator) *ConvertQueue {
+	q := &ConvertQueue{
+		queueFile:   defaultQueueFile,
+		concurrency: defaultConvertConcurrency,
+		onShutdown:  ShutdownCancel,
+		coordinator: coordinator,
+	}
+	if cfg != nil {
+		if cfg.QueueFile != "" {
+			q.queueFile = cfg.QueueFile
+		}
+		if cfg.Concurrency > 0 {
+			q.concurrency = cfg.Concurrency
+		}
+		if cfg.OnShutdown != "" {
+			q.onShutdown = cfg.OnShutdown
+		}
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	return q
+}
+
+// Start loads persisted jobs and starts the workers, which pass each job to handler.
+// The context given to handler is cancelled when the queue is stopped without finishing running jobs.
+func (q *ConvertQueue) Start(handler func(context.Context, *ConvertJob) error) {
+	q.handler = handler
+
+	if err := q.load(); err != nil {
+		log.Printf("Failed to load conversion queue %s: %v", q.queueFile, err)
+	}
+	q.mu.Lock()
+	q.updateDepthLocked()
+	q.mu.Unlock()
+
+	for i := 0; i < q.concurrency; i++ {
+		go q.work()
+	}
+	log.Printf("Conversion queue started with %d worker(s), %d pending job(s)", q.concurrency, q.pendingCount())
+}
+
+func (q *ConvertQueue) Enqueue(job *ConvertJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job.ID == "" {
+		job.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	job.Status = JobQueued
+	job.UpdatedAt = time.Now()
+	q.jobs = append(q.jobs, job)
+	q.persistLocked()
+	q.cond.Broadcast()
+
+	log.Printf("Queued conversion job [%s] for %s", job.ID, job.TsFilePath)
+}
+
+// Status returns the status of the job with the given ID.
+func (q *ConvertQueue) Status(id string) (JobStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range q.jobs {
+		if job.ID == id {
+			return job.Status, true
+		}
+	}
+	return "", false
+}
+
+// Retry queues a failed job again.
+func (q *ConvertQueue) Retry(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range q.jobs {
+		if job.ID != id {
+			continue
+		}
+		if job.Status != JobFailed {
+			return fmt.Errorf("conversion job [%s] is %s, not failed", id, job.Status)
+		}
+		job.Status = JobQueued
+		job.Error = ""
+		job.UpdatedAt = time.Now()
+		q.persistLocked()
+		q.cond.Broadcast()
+		log.Printf("Queued conversion job [%s] again for %s", job.ID, job.TsFilePath)
+		return nil
+	}
+	return fmt.Errorf("conversion job [%s] not found", id)
+}
+
+// Jobs returns a snapshot of all known jobs, oldest first.
+func (q *ConvertQueue) Jobs() []ConvertJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]ConvertJob, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+// Drain keeps the queue from starting new jobs and waits until no job is running.
+// Depending on the on-shutdown setting, running jobs are either allowed to finish until ctx is done,
+// or cancelled right away; cancelled jobs are left queued for the next start.
+func (q *ConvertQueue) Drain(ctx context.Context) []string {
+	stopCancelOnDone := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.running > 0 {
+			log.Printf("Grace period is over; cancelling %d running conversion(s)", q.running)
+		}
+		q.cancel()
+		q.cond.Broadcast()
+	})
+	defer stopCancelOnDone()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.stopped = true
+	if q.running > 0 && q.onShutdown == ShutdownFinish {
+		log.Printf("Waiting for %d running conversion(s) to finish", q.running)
+	} else if q.running > 0 {
+		log.Printf("Cancelling %d running conversion(s); they will resume on next start", q.running)
+		q.cancel()
+	}
+	for q.running > 0 {
+		q.cond.Wait()
+	}
+
+	var left []string
+	for _, job := range q.jobs {
+		if job.Status == JobQueued {
+			left = append(left, "queued conversion: "+job.TsFilePath)
+		}
+	}
+	return left
+}
+
+func (q *ConvertQueue) work() {
+	for {
+		job := q.next()
+		done := q.coordinator.Begin(shutdown.StageConverter, job.TsFilePath)
+		err := q.handler(q.ctx, job)
+		q.finish(job, err)
+		done()
+	}
+}
+
+// next blocks until a queued job is available and marks it running.
+func (q *ConvertQueue) next() *ConvertJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if !q.stopped && !q.coordinator.Stopping() {
+			for _, job := range q.jobs {
+				if job.Status == JobQueued {
+					job.Status = JobRunning
+					job.UpdatedAt = time.Now()
+					q.running++
+					q.persistLocked()
+					return job
+				}
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *ConvertQueue) finish(job *ConvertJob, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err != nil && q.ctx.Err() != nil {
+		// Cancelled by shutdown rather than failed; keep it for the next start.
+		job.Status = JobQueued
+	} else if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = JobDone
+	}
+	job.UpdatedAt = time.Now()
+	q.running--
+	q.pruneLocked()
+	q.persistLocked()
+	q.cond.Broadcast()
+}
+
+// pruneLocked forgets the oldest finished jobs beyond maxFinishedJobs.
+func (q *ConvertQueue) pruneLocked() {
+	finished := 0
+	for _, job := range q.jobs {
+		if job.Status == JobDone || job.Status == JobFailed {
+			finished++
+		}
+	}
+
+	kept := q.jobs[:0]
+	for _, job := range q.jobs {
+		if finished > maxFinishedJobs && (job.Status == JobDone || job.Status == JobFailed) {
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	q.jobs = kept
+}
+
+// pending reports whether a queued or running job still reads the given recording.
+func (q *ConvertQueue) pending(tsFilePath string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range q.jobs {
+		if job.TsFilePath == tsFilePath && (job.Status == JobQueued || job.Status == JobRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *ConvertQueue) pendingCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := 0
+	for _, job := range q.jobs {
+		if job.Status == JobQueued {
+			count++
+		}
+	}
+	return count
+}
+
+func (q *ConvertQueue) load() error {
+	data, err := os.ReadFile(q.queueFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var jobs []*ConvertJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range jobs {
+		job.migrate()
+		// A job still running when the process stopped is started over.
+		if job.Status == JobRunning {
+			job.Status = JobQueued
+		}
+		q.jobs = append(q.jobs, job)
+	}
+	return nil
+}
+
+// updateDepthLocked sets the queue depth metrics from the jobs queued and running.
+func (q *ConvertQueue) updateDepthLocked() {
+	depth := map[JobStatus]int{JobQueued: 0, JobRunning: 0}
+	for _, job := range q.jobs {
+		if job.Status == JobQueued || job.Status == JobRunning {
+			depth[job.Status]++
+		}
+	}
+	for status, count := range depth {
+		conversionQueueDepth.WithLabelValues(string(status)).Set(float64(count))
+	}
+}
+
+// persistLocked writes the unfinished jobs to the queue file.
+func (q *ConvertQueue) persistLocked() {
+	q.updateDepthLocked()
+
+	pending := make([]*ConvertJob, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		if job.Status == JobQueued || job.Status == JobRunning {
+			pending = append(pending, job)
+		}
+	}
+
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode conversion queue: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(q.queueFile), 0755); err != nil {
+		log.Printf("Failed to create folder for conversion queue %s: %v", q.queueFile, err)
+		return
+	}
+	tmpQueueFile := q.queueFile + ".tmp"
+	if err := os.WriteFile(tmpQueueFile, data, 0664); err != nil {
+		log.Printf("Failed to write conversion queue %s: %v", tmpQueueFile, err)
+		return
+	}
+	if err := os.Rename(tmpQueueFile, q.queueFile); err != nil {
+		log.Printf("Failed to replace conversion queue %s: %v", q.queueFile, err)
+	}
+}
@@ -0,0 +1,147 @@
+package sink
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/uploader"
+)
+
+const defaultPendingUploadsFile = baseRecordingPath + "/.pending-uploads.json"
+
+// pendingUpload is an upload that has not completed yet; it is retried on the next start if the process stops first.
+type pendingUpload struct {
+	FilePath  string            `json:"file_path"`
+	RemoteKey string            `json:"remote_key"`
+	Metadata  uploader.Metadata `json:"metadata"`
+	// RemoveAfterUpload is set once no later stage needs the file, which is then removed when the upload completes.
+	RemoveAfterUpload bool `json:"remove_after_upload,omitempty"`
+}
+
+// uploadJournal persists the uploads not completed yet, keyed by local file path.
+type uploadJournal struct {
+	mu      sync.Mutex
+	path    string
+	uploads map[string]*pendingUpload
+}
+
+func loadUploadJournal(path string) *uploadJournal {
+	j := &uploadJournal{path: path, uploads: make(map[string]*pendingUpload)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j
+	}
+	if err == nil {
+		var uploads []*pendingUpload
+		if err = json.Unmarshal(data, &uploads); err == nil {
+			for _, upload := range uploads {
+				j.uploads[upload.FilePath] = upload
+			}
+			return j
+		}
+	}
+	log.Printf("Failed to load pending uploads %s: %v", path, err)
+	return j
+}
+
+func (j *uploadJournal) add(upload pendingUpload) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if existing, ok := j.uploads[upload.FilePath]; ok {
+		upload.RemoveAfterUpload = existing.RemoveAfterUpload
+	}
+	j.uploads[upload.FilePath] = &upload
+	j.persistLocked()
+}
+
+// remove forgets the upload of filePath, and reports whether the file is to be removed now that it is done.
+func (j *uploadJournal) remove(filePath string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	upload, ok := j.uploads[filePath]
+	if !ok {
+		return false
+	}
+	delete(j.uploads, filePath)
+	j.persistLocked()
+	return upload.RemoveAfterUpload
+}
+
+// removeAfterUpload marks filePath for removal once its pending upload completes. It reports false if no upload
+// of it is pending, in which case the caller may remove it right away.
+func (j *uploadJournal) removeAfterUpload(filePath string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	upload, ok := j.uploads[filePath]
+	if !ok {
+		return false
+	}
+	upload.RemoveAfterUpload = true
+	j.persistLocked()
+	return true
+}
+
+// retryTargets limits the pending upload of filePath to the targets that failed, so that those already holding
+// the file are not uploaded to again. Without targets, as for a failure not tied to any, the upload is left as is.
+func (j *uploadJournal) retryTargets(filePath string, targets []string) {
+	if len(targets) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	upload, ok := j.uploads[filePath]
+	if !ok {
+		return
+	}
+	upload.Metadata.Targets = targets
+	j.persistLocked()
+}
+
+func (j *uploadJournal) has(filePath string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.uploads[filePath]
+	return ok
+}
+
+// snapshot returns the pending uploads ordered by file path.
+func (j *uploadJournal) snapshot() []pendingUpload {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	uploads := make([]pendingUpload, 0, len(j.uploads))
+	for _, upload := range j.uploads {
+		uploads = append(uploads, *upload)
+	}
+	sort.Slice(uploads, func(i, k int) bool { return uploads[i].FilePath < uploads[k].FilePath })
+	return uploads
+}
+
+func (j *uploadJournal) persistLocked() {
+	uploads := make([]*pendingUpload, 0, len(j.uploads))
+	for _, upload := range j.uploads {
+		uploads = append(uploads, upload)
+	}
+	sort.Slice(uploads, func(i, k int) bool { return uploads[i].FilePath < uploads[k].FilePath })
+
+	data, err := json.MarshalIndent(uploads, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode pending uploads: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		log.Printf("Failed to create folder for pending uploads %s: %v", j.path, err)
+		return
+	}
+	tmpPath := j.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0664); err != nil {
+		log.Printf("Failed to write pending uploads %s: %v", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		log.Printf("Failed to replace pending uploads %s: %v", j.path, err)
+	}
+}
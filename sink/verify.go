@@ -0,0 +1,90 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+const defaultDurationTolerance = 2 * time.Second
+
+// verifyOutput checks that a converted file is complete compared to its probed source:
+// durations must match within tolerance, it must hold the kinds of streams the ffmpeg arguments keep,
+// and both its first and last frames must decode.
+func verifyOutput(ctx context.Context, outputPath string, source *probeResult, ffmpegArgs []string, tolerance time.Duration) error {
+	output, err := probeFile(ctx, outputPath)
+	if err != nil {
+		return fmt.Errorf("probing %s failed: %w", outputPath, err)
+	}
+
+	if diff := (output.Duration - source.Duration).Abs(); diff > tolerance {
+		return fmt.Errorf("duration of %s is %s but source is %s", outputPath, output.Duration, source.Duration)
+	}
+
+	if err := checkStreams(output, source, ffmpegArgs); err != nil {
+		return fmt.Errorf("%s %w", outputPath, err)
+	}
+
+	frameSelector := "-frames:v"
+	if output.VideoStreams == 0 {
+		frameSelector = "-frames:a"
+	}
+	if err := decode(ctx, "-i", outputPath, frameSelector, "1"); err != nil {
+		return fmt.Errorf("decoding first frame of %s failed: %w", outputPath, err)
+	}
+	if err := decode(ctx, "-sseof", "-3", "-i", outputPath); err != nil {
+		return fmt.Errorf("decoding last frames of %s failed: %w", outputPath, err)
+	}
+	return nil
+}
+
+// checkStreams checks that the output holds every kind of stream of the source that the ffmpeg arguments keep,
+// and none they drop. Streams selected with -map are up to the profile, so any stream will do then.
+func checkStreams(output, source *probeResult, ffmpegArgs []string) error {
+	if slices.Contains(ffmpegArgs, "-map") {
+		if output.VideoStreams+output.AudioStreams == 0 {
+			return fmt.Errorf("has no video or audio stream")
+		}
+		return nil
+	}
+
+	wantVideo := source.VideoStreams > 0 && !slices.Contains(ffmpegArgs, "-vn")
+	wantAudio := source.AudioStreams > 0 && !slices.Contains(ffmpegArgs, "-an")
+	if (output.VideoStreams > 0) != wantVideo || (output.AudioStreams > 0) != wantAudio {
+		return fmt.Errorf(
+			"has %d video and %d audio stream(s), expected video: %t, audio: %t",
+			output.VideoStreams, output.AudioStreams, wantVideo, wantAudio,
+		)
+	}
+	return nil
+}
+
+// decode runs ffmpeg over the given input arguments, discarding the decoded frames.
+func decode(ctx context.Context, inputArgs ...string) error {
+	args := append([]string{"-nostdin", "-v", "error", "-xerror"}, inputArgs...)
+	args = append(args, "-f", "null", "-")
+
+	stderr := &lineTail{limit: stderrTailLines}
+	decodeCmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	decodeCmd.Stderr = stderr
+	if err := decodeCmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, stderr.last())
+	}
+	return nil
+}
+
+// verifyOutputs verifies every converted file, logging the outcome.
+func (f *FileSink) verifyOutputs(ctx context.Context, outputs []string, source *probeResult) error {
+	for _, outputPath := range outputs {
+		ffmpegArgs := f.outputArgs(outputPath, outputPath)
+		if err := verifyOutput(ctx, outputPath, source, ffmpegArgs, f.pipeline.durationTolerance); err != nil {
+			log.Printf("Verification failed, keeping %s: %v", f.tsFilePath, err)
+			return fmt.Errorf("verification failed: %w", err)
+		}
+		log.Printf("Verified %s", outputPath)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package status
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed dashboard
+var dashboardAssets embed.FS
+
+// dashboardFiles are the static files of the dashboard, which reads everything from the JSON API.
+var dashboardFiles, _ = fs.Sub(dashboardAssets, "dashboard")
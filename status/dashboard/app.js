@@ -0,0 +1,194 @@
+"use strict";
+
+const statusInterval = 3000;
+const historyInterval = 30000;
+
+let actions = false;
+
+// el creates an element with the given attributes and children; strings become text, never HTML.
+function el(tag, attrs = {}, ...children) {
+  const element = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs)) {
+    if (name === "onclick") {
+      element.onclick = value;
+    } else {
+      element.setAttribute(name, value);
+    }
+  }
+  for (const child of children) {
+    element.append(child instanceof Node ? child : String(child ?? ""));
+  }
+  return element;
+}
+
+function formatTime(value) {
+  return value ? new Date(value).toLocaleString() : "";
+}
+
+function formatDuration(ms) {
+  const seconds = Math.max(0, Math.floor(ms / 1000));
+  const h = Math.floor(seconds / 3600);
+  const m = Math.floor((seconds % 3600) / 60);
+  const s = seconds % 60;
+  return h > 0 ? `${h}h ${m}m` : m > 0 ? `${m}m ${s}s` : `${s}s`;
+}
+
+function formatSize(bytes) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let size = bytes;
+  let unit = 0;
+  while (size >= 1024 && unit < units.length - 1) {
+    size /= 1024;
+    unit++;
+  }
+  return `${size.toFixed(unit === 0 ? 0 : 1)} ${units[unit]}`;
+}
+
+function baseName(path) {
+  return path ? path.split("/").pop() : "";
+}
+
+// fill replaces the rows of a table body, or shows the empty message if there are none.
+function fill(id, rows, columns, emptyMessage) {
+  const body = document.getElementById(id);
+  body.replaceChildren(...rows);
+  if (rows.length === 0) {
+    body.append(el("tr", {}, el("td", { colspan: columns, class: "empty" }, emptyMessage)));
+  }
+}
+
+// actionButton posts to an action endpoint, then refreshes the dashboard.
+function actionButton(label, path, confirmMessage) {
+  const button = el("button", { type: "button" }, label);
+  button.disabled = !actions;
+  button.onclick = async () => {
+    if (confirmMessage && !confirm(confirmMessage)) {
+      return;
+    }
+    button.disabled = true;
+    try {
+      const response = await fetch(path, { method: "POST" });
+      if (!response.ok) {
+        alert(`${label} failed: ${(await response.text()).trim()}`);
+      }
+    } catch (err) {
+      alert(`${label} failed: ${err}`);
+    }
+    refreshStatus();
+  };
+  return button;
+}
+
+function renderStreamers(streamers) {
+  fill("streamers", streamers.map((streamer) => {
+    const status = streamer.recording
+      ? el("span", { class: "badge live" }, "recording")
+      : el("span", { class: "badge" }, "idle");
+    const lastCheck = streamer.last_check
+      ? el("span", {}, `${formatTime(streamer.last_check)} `,
+          el("span", { class: `badge ${streamer.last_result}` }, streamer.last_result))
+      : el("span", { class: "muted" }, "not yet");
+    return el("tr", {},
+      el("td", {}, el("a", { href: `https://twitcasting.tv/${encodeURIComponent(streamer.screen_id)}`, target: "_blank", rel: "noopener" }, streamer.screen_id)),
+      el("td", {}, status),
+      el("td", {}, lastCheck),
+      el("td", {}, formatTime(streamer.next_check), el("div", { class: "muted" }, streamer.schedule)),
+      el("td", {}, actionButton("Check now", `/api/streamers/${encodeURIComponent(streamer.screen_id)}/check`)),
+    );
+  }), 5, "No scheduled streamers");
+}
+
+function renderRecordings(recordings) {
+  const now = Date.now();
+  fill("recordings", recordings.map((recording) => el("tr", {},
+    el("td", {}, recording.streamer),
+    el("td", { class: "wrap" }, recording.title, recording.is_membership ? el("span", { class: "badge" }, "membership") : ""),
+    el("td", {}, formatTime(recording.started_at)),
+    el("td", {}, formatDuration(now - new Date(recording.started_at))),
+    el("td", {}, formatSize(recording.bytes_written)),
+    el("td", {}, actionButton("Stop", `/api/recordings/${encodeURIComponent(recording.streamer)}/stop`,
+      `Stop recording ${recording.streamer}? The stream will not be recorded again until its next broadcast.`)),
+  )), 6, "Nothing is being recorded");
+}
+
+function renderQueues(queues) {
+  const conversions = queues.conversions.map((job) => el("tr", {},
+    el("td", {}, "Conversion"),
+    el("td", {}, job.streamer),
+    el("td", { class: "wrap" }, baseName(job.ts_file_path)),
+    el("td", {}, job.status),
+    el("td", {}, formatTime(job.updated_at)),
+  ));
+  const uploads = queues.uploads.map((upload) => el("tr", {},
+    el("td", {}, upload.resumed ? "Upload (resumed)" : "Upload"),
+    el("td", {}, upload.streamer),
+    el("td", { class: "wrap" }, upload.remote_key),
+    el("td", {}, "uploading"),
+    el("td", {}, formatTime(upload.started_at)),
+  ));
+  fill("queues", [...conversions, ...uploads], 5, "No conversions or uploads in progress");
+}
+
+function renderFailures(failures) {
+  fill("failures", failures.map((failure) => el("tr", {},
+    el("td", {}, formatTime(failure.time)),
+    el("td", {}, failure.stage),
+    el("td", {}, failure.streamer),
+    el("td", { class: "wrap" }, baseName(failure.file_path)),
+    el("td", { class: "wrap" }, failure.error),
+    el("td", {}, failure.retryable ? actionButton("Retry", `/api/failures/${failure.id}/retry`) : ""),
+  )), 6, "No recent failures");
+}
+
+function renderHistory(history) {
+  fill("history", history.map((recording) => el("tr", {},
+    el("td", {}, formatTime(recording.started_at)),
+    el("td", {}, recording.streamer),
+    el("td", { class: "wrap" }, recording.title),
+    el("td", {}, recording.ended_at ? formatDuration(new Date(recording.ended_at) - new Date(recording.started_at)) : ""),
+    el("td", { class: "wrap" }, ...(recording.local_files.length > 0
+      ? recording.local_files.map((file) => el("a", { href: `/files/${file.path.split("/").map(encodeURIComponent).join("/")}`, download: file.name },
+          `${file.name} (${formatSize(file.size)})`))
+      : [el("span", { class: "muted" }, "removed after upload")])),
+  )), 5, "No finished recordings");
+}
+
+function showError(message) {
+  const error = document.getElementById("error");
+  error.textContent = message;
+  error.hidden = !message;
+}
+
+async function refreshStatus() {
+  try {
+    const response = await fetch("/api/status");
+    if (!response.ok) {
+      throw new Error(response.statusText);
+    }
+    const status = await response.json();
+    actions = status.actions;
+    renderStreamers(status.streamers);
+    renderRecordings(status.recordings);
+    renderQueues(status);
+    renderFailures(status.failures);
+    document.getElementById("updated").textContent = `Updated ${new Date().toLocaleTimeString()}`;
+    showError("");
+  } catch (err) {
+    showError(`Cannot reach the recorder: ${err.message}`);
+  }
+}
+
+async function refreshHistory() {
+  try {
+    const response = await fetch("/api/history");
+    if (response.ok) {
+      renderHistory(await response.json());
+    }
+  } catch (err) {
+    // The status refresh reports the recorder being unreachable.
+  }
+}
+
+refreshStatus().then(refreshHistory);
+setInterval(refreshStatus, statusInterval);
+setInterval(refreshHistory, historyInterval);
@@ -0,0 +1,293 @@
+package status
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/jzhang046/croned-twitcasting-recorder-mp4/sink"
+)
+
+const (
+	defaultListen       = "127.0.0.1:8080"
+	defaultHistoryLimit = 100
+	statusTokenEnv      = "RECORDER_STATUS_TOKEN"
+)
+
+// Streamer is a streamer checked on a schedule.
+type Streamer struct {
+	ScreenID  string    `json:"screen_id"`
+	Schedule  string    `json:"schedule"`
+	NextCheck time.Time `json:"next_check,omitzero"`
+	LastCheck time.Time `json:"last_check,omitzero"`
+	// LastResult is the result of the last check: online, offline or error.
+	LastResult string `json:"last_result,omitempty"`
+	Recording  bool   `json:"recording"`
+}
+
+// Scheduler checks streamers for live streams on a schedule.
+type Scheduler interface {
+	Streamers() []Streamer
+	// CheckNow checks the given streamer right away, and records the live stream if there is one.
+	CheckNow(screenId string) error
+}
+
+// Queues holds the conversions and uploads not finished yet.
+type Queues struct {
+	Conversions []sink.ConvertJob `json:"conversions"`
+	Uploads     []sink.Upload     `json:"uploads"`
+}
+
+// Status is the whole state of the recorder.
+type Status struct {
+	StartedAt time.Time `json:"started_at"`
+	// Actions tells whether actions such as stopping recordings are allowed.
+	Actions    bool             `json:"actions"`
+	Streamers  []Streamer       `json:"streamers"`
+	Recordings []sink.Recording `json:"recordings"`
+	Queues
+	Failures []sink.Failure `json:"failures"`
+}
+
+// Server serves the dashboard and the state of the running recorder as JSON over HTTP, and its metrics
+// to Prometheus. A nil Server is valid and serves nothing.
+type Server struct {
+	listen    string
+	actions   bool
+	token     string
+	pipeline  *sink.Pipeline
+	startedAt time.Time
+
+	mu        sync.Mutex
+	scheduler Scheduler
+}
+
+func NewServer(cfg *config.StatusConfig, pipeline *sink.Pipeline) *Server {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	s := &Server{
+		listen:    defaultListen,
+		actions:   cfg.Actions,
+		token:     cfg.Token,
+		pipeline:  pipeline,
+		startedAt: time.Now(),
+	}
+	if cfg.Listen != "" {
+		s.listen = cfg.Listen
+	}
+	if s.token == "" {
+		s.token = os.Getenv(statusTokenEnv)
+	}
+	return s
+}
+
+// SetScheduler sets the scheduler of the streamers, which are listed once it is running.
+func (s *Server) SetScheduler(scheduler Scheduler) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheduler = scheduler
+}
+
+func (s *Server) getScheduler() Scheduler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scheduler
+}
+
+// Start listens on the configured address and serves requests in the background.
+// The recorder keeps running without the server if the address cannot be listened on.
+func (s *Server) Start() {
+	if s == nil {
+		return
+	}
+	listener, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		log.Printf("Failed to start status server on %s: %v", s.listen, err)
+		return
+	}
+	log.Printf("Status server listening on %s", listener.Addr())
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() && s.token == "" {
+		log.Printf("Status server has no token; anyone reaching %s can see and download recordings", listener.Addr())
+	}
+	go func() {
+		if err := http.Serve(listener, s.handler()); err != nil {
+			log.Printf("Status server stopped: %v", err)
+		}
+	}()
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.status())
+	})
+	mux.HandleFunc("GET /api/streamers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Streamers())
+	})
+	mux.HandleFunc("GET /api/recordings", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.pipeline.Recordings())
+	})
+	mux.HandleFunc("GET /api/queues", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.queues())
+	})
+	mux.HandleFunc("GET /api/failures", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.pipeline.Failures())
+	})
+	mux.HandleFunc("GET /api/history", s.history)
+	mux.Handle("POST /api/streamers/{screenId}/check", s.action(s.checkNow))
+	mux.Handle("POST /api/recordings/{streamer}/stop", s.action(s.stopRecordings))
+	mux.Handle("POST /api/failures/{id}/retry", s.action(s.retry))
+	mux.Handle("GET /files/", http.StripPrefix("/files/", http.FileServerFS(sink.RecordingFiles())))
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.Handle("GET /", http.FileServerFS(dashboardFiles))
+	return s.authenticate(mux)
+}
+
+// authenticate requires the token on every request if one is set, either as a bearer token or, so that
+// browsers can open the dashboard, as the password of basic authentication.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if s.token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, token, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="recorder", charset="UTF-8"`)
+			http.Error(w, "a valid token is required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) status() Status {
+	return Status{
+		StartedAt:  s.startedAt,
+		Actions:    s.actions,
+		Streamers:  s.Streamers(),
+		Recordings: s.pipeline.Recordings(),
+		Queues:     s.queues(),
+		Failures:   s.pipeline.Failures(),
+	}
+}
+
+// Streamers returns the scheduled streamers, telling which of them are being recorded.
+func (s *Server) Streamers() []Streamer {
+	streamers := []Streamer{}
+	if scheduler := s.getScheduler(); scheduler != nil {
+		streamers = scheduler.Streamers()
+	}
+	recordings := s.pipeline.Recordings()
+	for i := range streamers {
+		streamers[i].Recording = slices.ContainsFunc(recordings, func(recording sink.Recording) bool {
+			return recording.Streamer == streamers[i].ScreenID
+		})
+	}
+	return streamers
+}
+
+// queues returns the conversions queued or running, and the uploads in progress.
+func (s *Server) queues() Queues {
+	conversions := []sink.ConvertJob{}
+	for _, job := range s.pipeline.ConvertQueue().Jobs() {
+		if job.Status == sink.JobQueued || job.Status == sink.JobRunning {
+			conversions = append(conversions, job)
+		}
+	}
+	return Queues{
+		Conversions: conversions,
+		Uploads:     s.pipeline.Uploads(),
+	}
+}
+
+// history lists the finished recordings, the last 100 unless the limit parameter says otherwise.
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	limit := defaultHistoryLimit
+	if param := r.URL.Query().Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	history, err := s.pipeline.History(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, history)
+}
+
+// action wraps a handler changing the state of the recorder. Actions are refused unless enabled and,
+// so that other web pages cannot trigger them from a browser, for requests from another origin.
+func (s *Server) action(handle func(r *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.actions {
+			http.Error(w, "actions are not enabled on the status server", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if originURL, err := url.Parse(origin); err != nil || originURL.Host != r.Host {
+				http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+				return
+			}
+		}
+		if err := handle(r); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (s *Server) checkNow(r *http.Request) error {
+	scheduler := s.getScheduler()
+	if scheduler == nil {
+		return errors.New("no streamer is scheduled")
+	}
+	return scheduler.CheckNow(r.PathValue("screenId"))
+}
+
+func (s *Server) stopRecordings(r *http.Request) error {
+	streamer := r.PathValue("streamer")
+	if s.pipeline.StopRecordings(streamer) == 0 {
+		return fmt.Errorf("streamer [%s] is not being recorded", streamer)
+	}
+	return nil
+}
+
+func (s *Server) retry(r *http.Request) error {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid failure ID: %w", err)
+	}
+	return s.pipeline.Retry(id)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write status response: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package twitcasting
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	checkOnline  = "online"
+	checkOffline = "offline"
+	checkError   = "error"
+)
+
+var (
+	liveChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twitcasting_recorder_live_checks_total",
+		Help: "Checks whether a streamer is live, by result: online, offline or error.",
+	}, []string{"streamer", "result"})
+	receivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twitcasting_recorder_received_bytes_total",
+		Help: "Bytes of stream data received from the websocket.",
+	}, []string{"streamer"})
+	websocketReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twitcasting_recorder_websocket_reconnects_total",
+		Help: "Websocket connections to a live stream that was connected to before.",
+	}, []string{"streamer"})
+	handshakeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twitcasting_recorder_websocket_handshake_failures_total",
+		Help: "Websocket connections that failed to be established, such as for missing membership.",
+	}, []string{"streamer"})
+)
+
+// Check is the outcome of checking whether a streamer is live.
+type Check struct {
+	Time   time.Time
+	Result string
+}
+
+// streams remembers the last check of each streamer, the last fragment received from each connected
+// streamer, and the last movie connected to, to tell reconnects.
+var streams = struct {
+	mu            sync.Mutex
+	lastChecks    map[string]Check
+	lastFragments map[string]time.Time
+	lastMovies    map[string]string
+}{
+	lastChecks:    make(map[string]Check),
+	lastFragments: make(map[string]time.Time),
+	lastMovies:    make(map[string]string),
+}
+
+func init() {
+	prometheus.MustRegister(lastFragmentCollector{prometheus.NewDesc(
+		"twitcasting_recorder_seconds_since_last_fragment",
+		"Seconds since the last stream data was received, for each streamer being recorded.",
+		[]string{"streamer"}, nil,
+	)})
+}
+
+// lastFragmentCollector reports the time since the last fragment of each connected streamer when scraped.
+type lastFragmentCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c lastFragmentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c lastFragmentCollector) Collect(ch chan<- prometheus.Metric) {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	for streamer, lastFragment := range streams.lastFragments {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(lastFragment).Seconds(), streamer)
+	}
+}
+
+func checked(streamer, result string) {
+	liveChecks.WithLabelValues(streamer, result).Inc()
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	streams.lastChecks[streamer] = Check{Time: time.Now(), Result: result}
+}
+
+// LastCheck returns the last check whether the given streamer is live, if any.
+func LastCheck(streamer string) (Check, bool) {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	check, ok := streams.lastChecks[streamer]
+	return check, ok
+}
+
+// connected tracks a new connection to the given movie of a streamer, and counts it if it is a reconnect.
+func connected(streamer, movieId string) {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	if movieId != "" && streams.lastMovies[streamer] == movieId {
+		websocketReconnects.WithLabelValues(streamer).Inc()
+	}
+	streams.lastMovies[streamer] = movieId
+	streams.lastFragments[streamer] = time.Now()
+}
+
+func fragmentReceived(streamer string, size int) {
+	receivedBytes.WithLabelValues(streamer).Add(float64(size))
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	streams.lastFragments[streamer] = time.Now()
+}
+
+func disconnected(streamer string) {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	delete(streams.lastFragments, streamer)
+}
@@ -2,10 +2,12 @@ package twitcasting
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/jmoiron/jsonq"
@@ -23,7 +25,20 @@ var httpClient = &http.Client{
 	Timeout: requestTimeout,
 }
 
-func fetchStreamInfo(streamer, cookie string) (*types.StreamInfo, error) {
+var errStreamOffline = errors.New("live stream is offline")
+
+func fetchStreamInfo(streamer, cookie string) (streamInfo *types.StreamInfo, err error) {
+	defer func() {
+		switch {
+		case err == nil:
+			checked(streamer, checkOnline)
+		case errors.Is(err, errStreamOffline):
+			checked(streamer, checkOffline)
+		default:
+			checked(streamer, checkError)
+		}
+	}()
+
 	u, _ := url.Parse(apiEndpoint)
 	q := u.Query()
 	q.Set("target", streamer)
@@ -59,6 +74,11 @@ func fetchStreamInfo(streamer, cookie string) (*types.StreamInfo, error) {
 
 	isProtected, _ := jq.Bool("movie", "is_protected") // Guessing the field name
 	password, _ := jq.String("fmp4", "password")
+	// An empty movie ID means unknown; "0" would make every stream look like the same movie.
+	var movieId string
+	if id, err := jq.Int("movie", "id"); err == nil {
+		movieId = strconv.Itoa(id)
+	}
 
 	// Try to get URL directly
 	streamUrl, err := getDirectStreamUrl(jq)
@@ -74,6 +94,7 @@ func fetchStreamInfo(streamer, cookie string) (*types.StreamInfo, error) {
 		Url:                streamUrl,
 		Password:           password,
 		IsMembershipStream: isProtected,
+		MovieId:            movieId,
 	}, nil
 
 }
@@ -87,7 +108,7 @@ func checkStreamOnline(jq *jsonq.JsonQuery) error {
 	if err != nil {
 		return fmt.Errorf("error checking stream online status: %w", err)
 	} else if !isLive {
-		return fmt.Errorf("live stream is offline")
+		return errStreamOffline
 	}
 	return nil
 }
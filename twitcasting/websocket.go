@@ -21,6 +21,7 @@ func RecordWS(recordCtx record.RecordContext, streamInfo *types.StreamInfo, sink
 	defer close(sinkChan)
 
 	streamer := recordCtx.GetStreamer()
+	defer disconnected(streamer)
 	connectionResultChan := make(chan error, 1)
 
 	socket.RequestHeader.Set("Origin", baseDomain)
@@ -34,17 +35,20 @@ func RecordWS(recordCtx record.RecordContext, streamInfo *types.StreamInfo, sink
 	}
 
 	socket.OnConnectError = func(err error, s gowebsocket.Socket) {
+		handshakeFailures.WithLabelValues(streamer).Inc()
 		connectionResultChan <- err
 		close(connectionResultChan)
 	}
 	socket.OnConnected = func(s gowebsocket.Socket) {
 		log.Printf("Connected to live stream for [%s], recording start \n", streamer)
+		connected(streamer, streamInfo.MovieId)
 		close(connectionResultChan) // Signal success
 	}
 	socket.OnTextMessage = func(message string, s gowebsocket.Socket) {
 		log.Println("Received message", message)
 	}
 	socket.OnBinaryMessage = func(data []byte, s gowebsocket.Socket) {
+		fragmentReceived(streamer, len(data))
 		sinkChan <- data
 	}
 	socket.OnDisconnected = func(err error, s gowebsocket.Socket) {
@@ -4,4 +4,13 @@ type StreamInfo struct {
 	Url                string
 	Password           string
 	IsMembershipStream bool
+	MovieId            string
+}
+
+// StreamMetadata describes a live stream as shown on twitcasting, without any sanitization.
+type StreamMetadata struct {
+	MovieId     string `json:"movie_id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	SourceUrl   string `json:"source_url"`
 }
@@ -0,0 +1,344 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	appconfig "github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+const (
+	// EncryptedSuffix is appended to the remote keys of encrypted files.
+	EncryptedSuffix = ".age"
+	encryptionAge   = "age"
+	ageHeader       = "age-encryption.org/v1"
+)
+
+// EncryptingUploader encrypts files with age before passing them on to another uploader.
+// Each file is encrypted into a hidden file next to it, which is kept until the upload succeeds,
+// so that a failed upload resumes with the same ciphertext.
+type EncryptingUploader struct {
+	uploader       Uploader
+	recipients     []age.Recipient
+	keyID          string
+	membershipOnly bool
+
+	mu       sync.Mutex
+	verified map[string]bool
+}
+
+func NewEncryptingUploader(u Uploader, cfg *appconfig.EncryptionConfig) (*EncryptingUploader, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, errors.New("encryption is not enabled")
+	}
+	e := &EncryptingUploader{
+		uploader:       u,
+		keyID:          cfg.KeyID,
+		membershipOnly: cfg.MembershipOnly,
+		verified:       make(map[string]bool),
+	}
+	for _, recipient := range cfg.Recipients {
+		parsed, err := parseRecipient(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("parsing recipient %q: %w", recipient, err)
+		}
+		e.recipients = append(e.recipients, parsed)
+	}
+	if len(e.recipients) == 0 {
+		return nil, errors.New("encryption requires at least one recipient")
+	}
+	if e.keyID == "" {
+		e.keyID = recipientsFingerprint(cfg.Recipients)
+	}
+	return e, nil
+}
+
+func parseRecipient(recipient string) (age.Recipient, error) {
+	recipient = strings.TrimSpace(recipient)
+	if strings.HasPrefix(recipient, "age1") {
+		return age.ParseX25519Recipient(recipient)
+	}
+	return agessh.ParseRecipient(recipient)
+}
+
+// recipientsFingerprint identifies a set of recipients regardless of their order.
+func recipientsFingerprint(recipients []string) string {
+	sorted := slices.Clone(recipients)
+	for i := range sorted {
+		sorted[i] = strings.TrimSpace(sorted[i])
+	}
+	slices.Sort(sorted)
+	digest := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(digest[:8])
+}
+
+func (e *EncryptingUploader) encrypts(metadata Metadata) bool {
+	return !e.membershipOnly || metadata.IsMembership
+}
+
+// Upload encrypts the file and uploads it to remotePath with EncryptedSuffix appended. If local files are
+// removed after upload, the encrypted copy is verified before it is removed, and remembered for Verify.
+func (e *EncryptingUploader) Upload(filePath, remotePath string, metadata Metadata) error {
+	if !e.encrypts(metadata) {
+		return e.uploader.Upload(filePath, remotePath, metadata)
+	}
+
+	encryptedPath := e.encryptedPath(filePath)
+	ciphertext := acquireCiphertext(encryptedPath)
+	err := ciphertext.prepare(func() error { return e.encryptFile(filePath, encryptedPath) })
+	if err != nil {
+		err = fmt.Errorf("encrypting %s: %w", filePath, err)
+	} else {
+		err = e.uploadEncrypted(filePath, encryptedPath, remotePath, metadata)
+	}
+	releaseCiphertext(encryptedPath, ciphertext, err == nil)
+	return err
+}
+
+func (e *EncryptingUploader) uploadEncrypted(filePath, encryptedPath, remotePath string, metadata Metadata) error {
+	encryptedRemotePath := remotePath + EncryptedSuffix
+	metadata.Encryption, metadata.EncryptionKeyID = encryptionAge, e.keyID
+	if err := e.uploader.Upload(encryptedPath, encryptedRemotePath, metadata); err != nil {
+		return err
+	}
+	if DeletesAfterUpload(e.uploader, metadata) {
+		if err := VerifyUpload(e.uploader, encryptedPath, encryptedRemotePath, metadata); err != nil {
+			return fmt.Errorf("verifying encrypted upload: %w", err)
+		}
+		e.mu.Lock()
+		e.verified[filePath+"\x00"+remotePath] = true
+		e.mu.Unlock()
+	}
+	return nil
+}
+
+// encryptedPath is where the ciphertext of filePath is kept until uploaded. It depends on the recipients,
+// so that a ciphertext for other recipients is never resumed.
+func (e *EncryptingUploader) encryptedPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+"."+e.keyID+EncryptedSuffix)
+}
+
+// sourcePath is the file whose ciphertext is kept at encryptedPath, or empty if encryptedPath is not one of ours.
+func (e *EncryptingUploader) sourcePath(encryptedPath string) string {
+	name := filepath.Base(encryptedPath)
+	suffix := "." + e.keyID + EncryptedSuffix
+	if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, suffix) || len(name) <= len(suffix)+1 {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(encryptedPath), strings.TrimSuffix(name[1:], suffix))
+}
+
+// encryptFile encrypts filePath into encryptedPath, reusing the ciphertext of an earlier attempt
+// unless the file changed since. The ciphertext is written to a temp file first, so that it is always complete.
+func (e *EncryptingUploader) encryptFile(filePath, encryptedPath string) error {
+	sourceInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(encryptedPath); err == nil && !info.ModTime().Before(sourceInfo.ModTime()) {
+		log.Printf("Reusing encrypted copy of %s", filepath.Base(filePath))
+		return nil
+	}
+
+	log.Printf("Encrypting %s for upload", filepath.Base(filePath))
+	source, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	encrypted, err := os.CreateTemp(filepath.Dir(encryptedPath), filepath.Base(encryptedPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	writer, err := age.Encrypt(encrypted, e.recipients...)
+	if err == nil {
+		_, err = io.Copy(writer, source)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := encrypted.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(encrypted.Name(), encryptedPath)
+	}
+	if err != nil {
+		os.Remove(encrypted.Name())
+		return err
+	}
+	return nil
+}
+
+// ciphertext is a kept encrypted copy, shared by the uploads of the same file to targets with the same recipients.
+type ciphertext struct {
+	mu       sync.Mutex
+	users    int
+	prepared bool
+	keep     bool
+}
+
+var (
+	ciphertextsMu sync.Mutex
+	ciphertexts   = make(map[string]*ciphertext)
+)
+
+func acquireCiphertext(encryptedPath string) *ciphertext {
+	ciphertextsMu.Lock()
+	defer ciphertextsMu.Unlock()
+	c := ciphertexts[encryptedPath]
+	if c == nil {
+		c = &ciphertext{}
+		ciphertexts[encryptedPath] = c
+	}
+	c.users++
+	return c
+}
+
+// releaseCiphertext removes the encrypted copy once its last user is done, unless an upload of it failed
+// and is to be resumed.
+func releaseCiphertext(encryptedPath string, c *ciphertext, uploaded bool) {
+	ciphertextsMu.Lock()
+	defer ciphertextsMu.Unlock()
+	c.users--
+	c.keep = c.keep || !uploaded
+	if c.users > 0 {
+		return
+	}
+	delete(ciphertexts, encryptedPath)
+	if !c.keep {
+		os.Remove(encryptedPath)
+	}
+}
+
+// prepare runs encrypt once for all current users of the ciphertext.
+func (c *ciphertext) prepare(encrypt func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.prepared {
+		return nil
+	}
+	if err := encrypt(); err != nil {
+		return err
+	}
+	c.prepared = true
+	return nil
+}
+
+func (e *EncryptingUploader) deletesAfterUpload(metadata Metadata) bool {
+	return DeletesAfterUpload(e.uploader, metadata)
+}
+
+// verify reports whether an encrypted upload was verified by Upload, as the encrypted copy
+// cannot be compared with the local file afterwards.
+func (e *EncryptingUploader) verify(filePath, remotePath string, metadata Metadata) error {
+	if !e.encrypts(metadata) {
+		return VerifyUpload(e.uploader, filePath, remotePath, metadata)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key := filePath + "\x00" + remotePath
+	if !e.verified[key] {
+		return fmt.Errorf("encrypted upload of %s was not verified", filePath)
+	}
+	delete(e.verified, key)
+	return nil
+}
+
+// Fetch reads the encrypted object back if there is one, otherwise the unencrypted one.
+func (e *EncryptingUploader) Fetch(remotePath string) (io.ReadCloser, error) {
+	fetcher, ok := e.uploader.(Fetcher)
+	if !ok {
+		return nil, errors.New("the uploader cannot read objects back")
+	}
+	if body, err := fetcher.Fetch(remotePath + EncryptedSuffix); err == nil {
+		return body, nil
+	}
+	return fetcher.Fetch(remotePath)
+}
+
+// UploadLive passes on files that are not encrypted; encrypted files are only uploaded once complete.
+func (e *EncryptingUploader) UploadLive(filePath, remotePath string, metadata Metadata) LiveUpload {
+	if e.encrypts(metadata) {
+		return nil
+	}
+	return StartLive(e.uploader, filePath, remotePath, metadata)
+}
+
+// Interrupted returns the interrupted uploads of the wrapped uploader. Those of a kept ciphertext are resumed
+// through this uploader with their source file, which reuses the ciphertext and removes it once uploaded.
+func (e *EncryptingUploader) Interrupted() []PendingUpload {
+	resumer, ok := e.uploader.(Resumer)
+	if !ok {
+		return nil
+	}
+	pending := resumer.Interrupted()
+	for i, upload := range pending {
+		sourcePath := e.sourcePath(upload.FilePath)
+		if sourcePath == "" || !strings.HasSuffix(upload.RemotePath, EncryptedSuffix) {
+			continue
+		}
+		if _, err := os.Stat(sourcePath); err != nil {
+			continue
+		}
+		pending[i] = PendingUpload{
+			FilePath:   sourcePath,
+			RemotePath: strings.TrimSuffix(upload.RemotePath, EncryptedSuffix),
+			Metadata:   upload.Metadata,
+			Uploader:   e,
+		}
+	}
+	return pending
+}
+
+func (e *EncryptingUploader) AbortOrphans() error {
+	if resumer, ok := e.uploader.(Resumer); ok {
+		return resumer.AbortOrphans()
+	}
+	return nil
+}
+
+// LoadIdentities reads the age identities, or an unencrypted SSH private key, from the given file.
+func LoadIdentities(identityPath string) ([]age.Identity, error) {
+	data, err := os.ReadFile(identityPath)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err == nil {
+		return identities, nil
+	}
+	sshIdentity, sshErr := agessh.ParseIdentity(data)
+	if sshErr != nil {
+		return nil, fmt.Errorf("not an age identity file (%v) nor an SSH private key (%v)", err, sshErr)
+	}
+	return []age.Identity{sshIdentity}, nil
+}
+
+// Decrypt returns the decrypted content of the age-encrypted r.
+func Decrypt(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	return age.Decrypt(r, identities...)
+}
+
+// DecryptIfEncrypted decrypts r if it is age-encrypted, and returns its content as is otherwise.
+func DecryptIfEncrypted(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	if header, _ := buffered.Peek(len(ageHeader)); string(header) != ageHeader {
+		return buffered, nil
+	}
+	return age.Decrypt(buffered, identities...)
+}
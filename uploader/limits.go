@@ -0,0 +1,238 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	appconfig "github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+const (
+	holdPollInterval = 30 * time.Second
+	// throttleChunkSize keeps throttled writes small, so that the rate stays smooth.
+	throttleChunkSize = 32 << 10
+)
+
+// ErrUploadHeld is returned for uploads still held when shutdown begins. They are left for the next start.
+var ErrUploadHeld = errors.New("upload still held at shutdown")
+
+// Limits are shared by all uploaders: the total bandwidth cap, the upload windows,
+// and what to do with uploads while recordings are active.
+type Limits struct {
+	global              *tokenBucket
+	whileRecording      *tokenBucket
+	pauseWhileRecording bool
+	windows             []appconfig.UploadWindow
+	recordingActive     func() bool
+	ctx                 context.Context
+}
+
+func NewLimits(cfg *appconfig.UploadConfig) *Limits {
+	l := &Limits{}
+	if cfg == nil {
+		return l
+	}
+	l.global = newTokenBucket(cfg.BandwidthLimitKB)
+	switch cfg.WhileRecording {
+	case "throttle":
+		l.whileRecording = newTokenBucket(cfg.RecordingBandwidthLimitKB)
+	case "pause":
+		l.pauseWhileRecording = true
+	}
+	for _, window := range cfg.Windows {
+		// Already validated with the config.
+		if uploadWindow, err := appconfig.ParseUploadWindow(window); err == nil {
+			l.windows = append(l.windows, uploadWindow)
+		}
+	}
+	return l
+}
+
+// SetRecordingActive sets how to tell whether any recording is active. It must be called before uploads start.
+func (l *Limits) SetRecordingActive(active func() bool) {
+	l.recordingActive = active
+}
+
+// SetContext sets the context ending held uploads once it is done. It must be called before uploads start.
+func (l *Limits) SetContext(ctx context.Context) {
+	l.ctx = ctx
+}
+
+func (l *Limits) recording() bool {
+	return l.recordingActive != nil && l.recordingActive()
+}
+
+// holdReason tells why an upload may not start at t, or is empty if it may.
+func (l *Limits) holdReason(t time.Time) string {
+	if len(l.windows) > 0 {
+		open := false
+		for _, window := range l.windows {
+			open = open || window.Contains(t)
+		}
+		if !open {
+			return "until an upload window opens"
+		}
+	}
+	if l.pauseWhileRecording && l.recording() {
+		return "while recordings are active"
+	}
+	return ""
+}
+
+// wait holds the upload of filePath until it may start. Uploads that have already started are not paused,
+// as connections would time out; they are throttled instead if configured. It returns ErrUploadHeld
+// if the context set with SetContext is done first.
+func (l *Limits) wait(filePath string) error {
+	if l == nil {
+		return nil
+	}
+	var done <-chan struct{}
+	if l.ctx != nil {
+		done = l.ctx.Done()
+	}
+	held := false
+	for {
+		reason := l.holdReason(time.Now())
+		if reason == "" {
+			if held {
+				log.Printf("Releasing upload of %s", filepath.Base(filePath))
+			}
+			return nil
+		}
+		if !held {
+			log.Printf("Holding upload of %s %s", filepath.Base(filePath), reason)
+			held = true
+		}
+		select {
+		case <-done:
+			log.Printf("Leaving held upload of %s for the next start", filepath.Base(filePath))
+			return ErrUploadHeld
+		case <-time.After(holdPollInterval):
+		}
+	}
+}
+
+// bandwidth returns the limits applying to an uploader capped at limitKB KiB/s itself,
+// or nil if its uploads are not limited at all.
+func (l *Limits) bandwidth(limitKB int) *bandwidth {
+	b := &bandwidth{own: newTokenBucket(limitKB), limits: l}
+	if b.own == nil && (b.limits == nil || b.limits.global == nil && b.limits.whileRecording == nil) {
+		return nil
+	}
+	return b
+}
+
+// bandwidth throttles the uploads of one uploader, by its own cap and the shared ones.
+type bandwidth struct {
+	own    *tokenBucket
+	limits *Limits
+}
+
+// take blocks until n more bytes may be sent.
+func (b *bandwidth) take(n int) {
+	b.own.take(n)
+	if b.limits != nil {
+		b.limits.global.take(n)
+		if b.limits.whileRecording != nil && b.limits.recording() {
+			b.limits.whileRecording.take(n)
+		}
+	}
+}
+
+// dialContext wraps dial so that writes to the connections it opens are throttled. It returns dial as is
+// for a nil bandwidth.
+func (b *bandwidth) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if b == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &throttledConn{Conn: conn, bandwidth: b}, nil
+	}
+}
+
+// writer throttles writes to w. It returns w as is for a nil bandwidth.
+func (b *bandwidth) writer(w io.Writer) io.Writer {
+	if b == nil {
+		return w
+	}
+	return &throttledWriter{w: w, bandwidth: b}
+}
+
+type throttledConn struct {
+	net.Conn
+	bandwidth *bandwidth
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	return throttledWrite(c.Conn, c.bandwidth, p)
+}
+
+type throttledWriter struct {
+	w         io.Writer
+	bandwidth *bandwidth
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	return throttledWrite(t.w, t.bandwidth, p)
+}
+
+func throttledWrite(w io.Writer, b *bandwidth, p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunkSize)]
+		b.take(len(chunk))
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// tokenBucket lets through bytes at a steady rate, with bursts of up to one second's worth.
+// Takers beyond the available tokens go into debt and sleep it off, so concurrent takers queue fairly.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket for limitKB KiB/s, or nil for no limit.
+func newTokenBucket(limitKB int) *tokenBucket {
+	if limitKB <= 0 {
+		return nil
+	}
+	rate := float64(limitKB) * 1024
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take blocks until n bytes may be sent. A nil bucket never blocks.
+func (b *tokenBucket) take(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,225 @@
+package uploader
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const (
+	defaultLivePartSizeBytes = 8 << 20
+	liveRetryDelay           = 10 * time.Second
+)
+
+// LiveUploader is implemented by uploaders that can upload a file while it is still being written.
+type LiveUploader interface {
+	// UploadLive starts uploading filePath as it grows, or returns nil if live upload is not enabled.
+	// A regular Upload of the finished file completes it, resuming from what was uploaded live.
+	UploadLive(filePath, remotePath string, metadata Metadata) LiveUpload
+}
+
+// LiveUpload is a file being uploaded while it is written.
+type LiveUpload interface {
+	// Written tells that the file has grown to size bytes.
+	Written(size int64)
+	// Stop waits for the upload in flight and stops uploading; the rest is left to Upload.
+	Stop()
+}
+
+// s3LiveUpload uploads each full part of a growing file as soon as it is written, into a multipart upload
+// kept in the state file. Once the recording ends, Upload uploads the last part and completes the object.
+type s3LiveUpload struct {
+	u          *S3Uploader
+	filePath   string
+	remotePath string
+	metadata   Metadata
+
+	size    atomic.Int64
+	grown   chan struct{}
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func (u *S3Uploader) UploadLive(filePath, remotePath string, metadata Metadata) LiveUpload {
+	if !u.live {
+		return nil
+	}
+	l := &s3LiveUpload{
+		u:          u,
+		filePath:   filePath,
+		remotePath: remotePath,
+		metadata:   metadata,
+		grown:      make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	u.running.Store(remotePath, true)
+	l.stopped.Add(1)
+	go l.run()
+	log.Printf("Start uploading %s live to s3://%s/%s%s", filePath, u.bucket, u.prefix, remotePath)
+	return l
+}
+
+func (l *s3LiveUpload) Written(size int64) {
+	l.size.Store(size)
+	select {
+	case l.grown <- struct{}{}:
+	default:
+	}
+}
+
+func (l *s3LiveUpload) Stop() {
+	close(l.stop)
+	l.stopped.Wait()
+	l.u.running.Delete(l.remotePath)
+}
+
+func (l *s3LiveUpload) run() {
+	defer l.stopped.Done()
+
+	file, err := os.Open(l.filePath)
+	if err != nil {
+		log.Printf("Failed to upload %s live: %v", filepath.Base(l.filePath), err)
+		return
+	}
+	defer file.Close()
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-l.grown:
+		case <-retry:
+		case <-l.stop:
+			return
+		}
+		retry = nil
+		if err := l.uploadFullParts(file); err != nil {
+			log.Printf("Failed to upload part of %s live, retrying in %s: %v", filepath.Base(l.filePath), liveRetryDelay, err)
+			retry = time.After(liveRetryDelay)
+		}
+	}
+}
+
+// uploadFullParts uploads the parts completely written so far. The last part of the multipart upload
+// is never uploaded here, since only the last part may be smaller than the others.
+func (l *s3LiveUpload) uploadFullParts(file *os.File) error {
+	upload := l.u.state.get(l.remotePath)
+	if upload != nil && !upload.Live {
+		return nil // Uploaded by Upload already
+	}
+
+	for {
+		select {
+		case <-l.stop:
+			return nil
+		default:
+		}
+
+		var partSize int64 = l.u.livePartSize
+		if upload != nil {
+			partSize = upload.PartSize
+		}
+		uploaded := int64(len(l.u.state.parts(l.remotePath)))
+		if l.size.Load() < (uploaded+1)*partSize || uploaded+1 >= maxUploadParts {
+			return nil
+		}
+
+		if upload == nil {
+			var err error
+			if upload, err = l.u.createLiveUpload(file.Name(), l.remotePath, l.metadata); err != nil {
+				return err
+			}
+		}
+		if err := l.u.uploadPart(context.Background(), file, l.remotePath, upload, int32(uploaded+1), partSize); err != nil {
+			return err
+		}
+	}
+}
+
+// createLiveUpload starts the multipart upload of a file being written, with the live part size.
+func (u *S3Uploader) createLiveUpload(filePath, remotePath string, metadata Metadata) (*multipartUpload, error) {
+	output, err := u.client.CreateMultipartUpload(context.Background(), u.createMultipartInput(filePath, remotePath, metadata))
+	if err != nil {
+		return nil, err
+	}
+	upload := &multipartUpload{
+		UploadId:  aws.ToString(output.UploadId),
+		FilePath:  filePath,
+		PartSize:  u.livePartSize,
+		Checksum:  u.checksumAlgorithm() != "",
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+		Live:      true,
+	}
+	u.state.put(remotePath, upload)
+	return upload, nil
+}
+
+// liveUpload returns the upload of remotePath started while its file was written, if there is one.
+func (u *S3Uploader) liveUpload(remotePath string) *multipartUpload {
+	if upload := u.state.get(remotePath); upload != nil && upload.Live {
+		return upload
+	}
+	return nil
+}
+
+// completeUploaded completes an upload started live with the parts that reached the bucket,
+// for when the rest of the file is gone.
+func (u *S3Uploader) completeUploaded(remotePath string, upload multipartUpload) error {
+	parts, err := u.listParts(context.Background(), remotePath, upload.UploadId)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		u.abort(remotePath, upload.UploadId)
+		return nil
+	}
+	if err := u.completeMultipart(context.Background(), remotePath, upload.UploadId, parts); err != nil {
+		return err
+	}
+	u.state.remove(remotePath)
+	return nil
+}
+
+// UploadLive starts a live upload on every accepting target supporting it, or returns nil if there is none.
+func (m *MultiUploader) UploadLive(filePath, remotePath string, metadata Metadata) LiveUpload {
+	var uploads multiLiveUpload
+	for _, target := range m.accepting(metadata) {
+		if liveUploader, ok := target.uploader.(LiveUploader); ok {
+			if upload := liveUploader.UploadLive(filePath, remotePath, metadata); upload != nil {
+				uploads = append(uploads, upload)
+			}
+		}
+	}
+	if len(uploads) == 0 {
+		return nil
+	}
+	return uploads
+}
+
+type multiLiveUpload []LiveUpload
+
+func (m multiLiveUpload) Written(size int64) {
+	for _, upload := range m {
+		upload.Written(size)
+	}
+}
+
+func (m multiLiveUpload) Stop() {
+	for _, upload := range m {
+		upload.Stop()
+	}
+}
+
+// StartLive starts uploading filePath with u while it is written, if u supports it; otherwise it returns nil.
+func StartLive(u Uploader, filePath, remotePath string, metadata Metadata) LiveUpload {
+	if liveUploader, ok := u.(LiveUploader); ok {
+		return liveUploader.UploadLive(filePath, remotePath, metadata)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	appconfig "github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+// LocalUploader copies files into a directory tree, such as a mounted NAS.
+type LocalUploader struct {
+	root      string
+	move      bool
+	bandwidth *bandwidth
+	limits    *Limits
+}
+
+func NewLocalUploader(cfg *appconfig.LocalConfig, limits *Limits) (*LocalUploader, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, errors.New("local configuration is not enabled")
+	}
+	if err := os.MkdirAll(cfg.Path, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalUploader{
+		root:      cfg.Path,
+		move:      cfg.Move,
+		bandwidth: limits.bandwidth(cfg.BandwidthLimitKB),
+		limits:    limits,
+	}, nil
+}
+
+func (u *LocalUploader) targetPath(remotePath string) string {
+	return filepath.Join(u.root, filepath.FromSlash(remotePath))
+}
+
+// Upload copies the file to a temp file next to the target, syncs it, checks its size and checksum
+// against the source, and only then renames it into place, keeping the source modification time.
+func (u *LocalUploader) Upload(filePath, remotePath string, metadata Metadata) error {
+	if err := u.limits.wait(filePath); err != nil {
+		return err
+	}
+
+	targetPath := u.targetPath(remotePath)
+	log.Printf("Start copying %s to %s", filePath, targetPath)
+
+	err := u.copyFile(filePath, targetPath)
+	uploadDone(backendLocal, filePath, err)
+	if err != nil {
+		log.Printf("Failed to copy %s to %s: %v", filepath.Base(filePath), targetPath, err)
+		return err
+	}
+
+	log.Printf("Completed copying %s", filepath.Base(filePath))
+	return nil
+}
+
+func (u *LocalUploader) copyFile(filePath, targetPath string) error {
+	source, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	sourceInfo, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	targetDir := filepath.Dir(targetPath)
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(targetDir, "."+filepath.Base(targetPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name()) // No-op once renamed
+
+	sourceHasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(u.bandwidth.writer(tmpFile), sourceHasher), source)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if written != sourceInfo.Size() {
+		return fmt.Errorf("copied %d bytes, source has %d", written, sourceInfo.Size())
+	}
+	if err := verifyCopy(tmpFile.Name(), written, sourceHasher.Sum(nil)); err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(tmpFile.Name(), sourceInfo.ModTime(), sourceInfo.ModTime()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), targetPath); err != nil {
+		return err
+	}
+	return syncDir(targetDir)
+}
+
+// verifyCopy reads the copy back and compares its size and SHA-256 with the source.
+func verifyCopy(copyPath string, size int64, digest []byte) error {
+	copied, err := os.Open(copyPath)
+	if err != nil {
+		return err
+	}
+	defer copied.Close()
+
+	copyHasher := sha256.New()
+	copiedSize, err := io.Copy(copyHasher, copied)
+	if err != nil {
+		return err
+	}
+	if copiedSize != size {
+		return fmt.Errorf("copy has %d bytes, source has %d", copiedSize, size)
+	}
+	if !bytes.Equal(copyHasher.Sum(nil), digest) {
+		return errors.New("checksum of the copy does not match the source")
+	}
+	return nil
+}
+
+// syncDir persists the rename in the directory entry; not every platform supports it, so failures are only logged.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		log.Printf("Failed to sync directory %s: %v", dir, err)
+	}
+	return nil
+}
+
+func (u *LocalUploader) Fetch(remotePath string) (io.ReadCloser, error) {
+	return os.Open(u.targetPath(remotePath))
+}
+
+func (u *LocalUploader) DeletesAfterUpload() bool {
+	return u.move
+}
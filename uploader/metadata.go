@@ -0,0 +1,79 @@
+package uploader
+
+import (
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// contentTypes covers the files produced by the recorder; anything else is looked up by extension.
+var contentTypes = map[string]string{
+	".ts":   "video/mp2t",
+	".mp4":  "video/mp4",
+	".m4a":  "audio/mp4",
+	".mov":  "video/quicktime",
+	".mkv":  "video/x-matroska",
+	".json": "application/json",
+}
+
+// Artifact types of the files of a recording, which upload targets can be limited to.
+const (
+	ArtifactRaw      = "raw"
+	ArtifactVideo    = "mp4"
+	ArtifactSidecars = "sidecars"
+)
+
+// Metadata describes the recording an uploaded file belongs to.
+type Metadata struct {
+	Streamer     string    `json:"streamer,omitempty"`
+	Title        string    `json:"title,omitempty"`
+	MovieID      string    `json:"movie_id,omitempty"`
+	StartedAt    time.Time `json:"started_at,omitempty"`
+	IsMembership bool      `json:"is_membership,omitempty"`
+	// Artifact is the type of the file itself, one of the Artifact constants.
+	Artifact string `json:"artifact,omitempty"`
+	// Encryption and EncryptionKeyID describe how an encrypted file was encrypted.
+	Encryption      string `json:"encryption,omitempty"`
+	EncryptionKeyID string `json:"encryption_key_id,omitempty"`
+	// Targets limits the upload to these targets of a MultiUploader, such as those that failed before;
+	// empty means all targets accepting the file.
+	Targets []string `json:"targets,omitempty"`
+}
+
+// objectMetadata returns the metadata as object metadata. Header values must be ASCII,
+// so non-ASCII values are stored as RFC 2047 encoded words. Object metadata is not encrypted,
+// so encrypted files leave out what identifies the recording.
+func (m Metadata) objectMetadata() map[string]string {
+	metadata := map[string]string{
+		"is-membership":     strconv.FormatBool(m.IsMembership),
+		"encryption":        m.Encryption,
+		"encryption-key-id": m.EncryptionKeyID,
+	}
+	if m.Encryption == "" {
+		metadata["streamer"] = mime.QEncoding.Encode("utf-8", m.Streamer)
+		metadata["title"] = mime.QEncoding.Encode("utf-8", m.Title)
+		metadata["movie-id"] = m.MovieID
+	}
+	if !m.StartedAt.IsZero() {
+		metadata["started-at"] = m.StartedAt.Format(time.RFC3339)
+	}
+	for key, value := range metadata {
+		if value == "" {
+			delete(metadata, key)
+		}
+	}
+	return metadata
+}
+
+func contentType(filePath string) string {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	if contentType, ok := contentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
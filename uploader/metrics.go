@@ -0,0 +1,38 @@
+package uploader
+
+import (
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	backendR2     = "r2"
+	backendS3     = "s3"
+	backendLocal  = "local"
+	backendWebDAV = "webdav"
+	backendSFTP   = "sftp"
+)
+
+var (
+	uploadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twitcasting_recorder_uploaded_bytes_total",
+		Help: "Bytes uploaded, by backend. S3 and R2 count each uploaded part, the others each uploaded file.",
+	}, []string{"backend"})
+	uploadFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twitcasting_recorder_upload_failures_total",
+		Help: "Uploads that failed, by backend.",
+	}, []string{"backend"})
+)
+
+// uploadDone counts a finished upload of filePath by the given backend.
+func uploadDone(backend, filePath string, err error) {
+	if err != nil {
+		uploadFailures.WithLabelValues(backend).Inc()
+		return
+	}
+	if fileInfo, err := os.Stat(filePath); err == nil {
+		uploadedBytes.WithLabelValues(backend).Add(float64(fileInfo.Size()))
+	}
+}
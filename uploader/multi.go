@@ -0,0 +1,272 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	appconfig "github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+// uploadTarget is one destination of a MultiUploader, with the filters choosing the files it receives.
+type uploadTarget struct {
+	name       string
+	uploader   Uploader
+	artifacts  []string
+	streamers  []string
+	membership string
+}
+
+// accepts reports whether the file described by metadata goes to this target. Files of unknown
+// artifact type, such as those of uploads interrupted before targets were configured, pass the artifact filter.
+func (t *uploadTarget) accepts(metadata Metadata) bool {
+	if len(metadata.Targets) > 0 && !slices.Contains(metadata.Targets, t.name) {
+		return false
+	}
+	if len(t.artifacts) > 0 && metadata.Artifact != "" && !slices.Contains(t.artifacts, metadata.Artifact) {
+		return false
+	}
+	if len(t.streamers) > 0 && !slices.Contains(t.streamers, metadata.Streamer) {
+		return false
+	}
+	switch t.membership {
+	case "only":
+		return metadata.IsMembership
+	case "exclude":
+		return !metadata.IsMembership
+	}
+	return true
+}
+
+func (t *uploadTarget) unfiltered() bool {
+	return len(t.artifacts) == 0 && len(t.streamers) == 0 && t.membership == ""
+}
+
+// MultiUploader delivers each file to every target accepting it, independently of each other.
+type MultiUploader struct {
+	targets []*uploadTarget
+}
+
+// New creates the uploaders of the given targets. A target failing to initialize is left out.
+// It returns the uploader itself for a single unfiltered target, and nil if no target is usable.
+func New(targets []*appconfig.UploadTarget, limits *Limits) Uploader {
+	multi := &MultiUploader{}
+	defaultStateFileTaken := false
+	for _, target := range targets {
+		isS3 := target.R2 != nil || target.S3 != nil
+		u, err := newTargetUploader(target, limits, isS3 && defaultStateFileTaken)
+		defaultStateFileTaken = defaultStateFileTaken || isS3
+		if err != nil {
+			log.Printf("Failed to initialize upload target [%s]: %v. Uploads to it will be disabled.", target.Name, err)
+			continue
+		}
+		log.Printf("Upload target [%s] initialized.", target.Name)
+		multi.targets = append(multi.targets, &uploadTarget{
+			name:       target.Name,
+			uploader:   u,
+			artifacts:  target.Artifacts,
+			streamers:  target.Streamers,
+			membership: target.Membership,
+		})
+	}
+
+	switch {
+	case len(multi.targets) == 0:
+		return nil
+	case len(multi.targets) == 1 && multi.targets[0].unfiltered():
+		return multi.targets[0].uploader
+	}
+	return multi
+}
+
+// newTargetUploader creates the uploader of a target, encrypting files if configured. The first S3 target keeps
+// its multipart state in the default file, so that a top-level r2 or s3 section resumes the uploads of earlier
+// versions; the others keep theirs in a file of their own unless one is given.
+func newTargetUploader(target *appconfig.UploadTarget, limits *Limits, ownStateFile bool) (Uploader, error) {
+	s3Config := func(cfg *appconfig.S3Config) *appconfig.S3Config {
+		if !ownStateFile || cfg.StateFile != "" {
+			return cfg
+		}
+		targetCfg := *cfg
+		targetCfg.StateFile = strings.TrimSuffix(defaultUploadStateFile, ".json") + "." + target.Name + ".json"
+		return &targetCfg
+	}
+	var u Uploader
+	var err error
+	switch {
+	case target.R2 != nil:
+		u, err = NewR2Uploader(s3Config(target.R2), limits)
+	case target.S3 != nil:
+		u, err = NewS3Uploader(s3Config(target.S3), limits)
+	case target.Local != nil:
+		u, err = NewLocalUploader(target.Local, limits)
+	case target.WebDAV != nil:
+		u, err = NewWebDAVUploader(target.WebDAV, limits)
+	case target.SFTP != nil:
+		u, err = NewSFTPUploader(target.SFTP, limits)
+	default:
+		err = errors.New("no backend configured")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if target.Encryption != nil && target.Encryption.Enabled {
+		return NewEncryptingUploader(u, target.Encryption)
+	}
+	return u, nil
+}
+
+// Target returns the uploader of the named target.
+func (m *MultiUploader) Target(name string) (Uploader, bool) {
+	for _, target := range m.targets {
+		if target.name == name {
+			return target.uploader, true
+		}
+	}
+	return nil, false
+}
+
+func (m *MultiUploader) accepting(metadata Metadata) []*uploadTarget {
+	var accepting []*uploadTarget
+	for _, target := range m.targets {
+		if target.accepts(metadata) {
+			accepting = append(accepting, target)
+		}
+	}
+	return accepting
+}
+
+// Accepts reports whether u uploads the file described by metadata at all.
+func Accepts(u Uploader, metadata Metadata) bool {
+	if multi, ok := u.(*MultiUploader); ok {
+		return len(multi.accepting(metadata)) > 0
+	}
+	return u != nil
+}
+
+// TargetsError is returned by MultiUploader.Upload when some targets failed; the others have their copy.
+type TargetsError struct {
+	// Failed are the names of the targets that failed.
+	Failed []string
+	err    error
+}
+
+func (e *TargetsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *TargetsError) Unwrap() error {
+	return e.err
+}
+
+// FailedTargets returns the targets that failed the upload returning err, so that a retry can be limited
+// to them, or nil if it is to go to all targets.
+func FailedTargets(err error) []string {
+	var targetsErr *TargetsError
+	if errors.As(err, &targetsErr) {
+		return targetsErr.Failed
+	}
+	return nil
+}
+
+// Upload delivers the file to all accepting targets at the same time, and logs the status of each.
+// A failed target does not stop the others; the returned TargetsError names every target that failed.
+func (m *MultiUploader) Upload(filePath, remotePath string, metadata Metadata) error {
+	targets := m.accepting(metadata)
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := target.uploader.Upload(filePath, remotePath, metadata); err != nil {
+				errs[i] = fmt.Errorf("target [%s]: %w", target.name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, target := range targets {
+		if errs[i] != nil {
+			failed = append(failed, target.name)
+		}
+	}
+	if len(failed) == 0 {
+		log.Printf("Uploaded %s to all %d target(s)", filepath.Base(filePath), len(targets))
+		return nil
+	}
+	log.Printf(
+		"Uploaded %s to %d of %d target(s); failed: %s",
+		filepath.Base(filePath), len(targets)-len(failed), len(targets), strings.Join(failed, ", "),
+	)
+	return &TargetsError{Failed: failed, err: errors.Join(errs...)}
+}
+
+// deletesAfterUpload reports whether any target accepting the file asks for local files to be removed.
+func (m *MultiUploader) deletesAfterUpload(metadata Metadata) bool {
+	metadata.Targets = nil
+	return slices.ContainsFunc(m.accepting(metadata), func(target *uploadTarget) bool {
+		return DeletesAfterUpload(target.uploader, metadata)
+	})
+}
+
+// verify checks the upload on every accepting target, so that a local file is only removed once all copies match,
+// including those uploaded before a retry limited to the failed targets.
+func (m *MultiUploader) verify(filePath, remotePath string, metadata Metadata) error {
+	metadata.Targets = nil
+	for _, target := range m.accepting(metadata) {
+		if err := VerifyUpload(target.uploader, filePath, remotePath, metadata); err != nil {
+			return fmt.Errorf("target [%s]: %w", target.name, err)
+		}
+	}
+	return nil
+}
+
+// Fetch reads the object back from the first target holding it.
+func (m *MultiUploader) Fetch(remotePath string) (io.ReadCloser, error) {
+	var errs []error
+	for _, target := range m.targets {
+		fetcher, ok := target.uploader.(Fetcher)
+		if !ok {
+			continue
+		}
+		body, err := fetcher.Fetch(remotePath)
+		if err == nil {
+			return body, nil
+		}
+		errs = append(errs, fmt.Errorf("target [%s]: %w", target.name, err))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no target can read objects back")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Interrupted returns the interrupted uploads of all targets, each to be resumed by its own target only.
+func (m *MultiUploader) Interrupted() []PendingUpload {
+	var pending []PendingUpload
+	for _, target := range m.targets {
+		if resumer, ok := target.uploader.(Resumer); ok {
+			pending = append(pending, resumer.Interrupted()...)
+		}
+	}
+	return pending
+}
+
+func (m *MultiUploader) AbortOrphans() error {
+	var errs []error
+	for _, target := range m.targets {
+		if resumer, ok := target.uploader.(Resumer); ok {
+			if err := resumer.AbortOrphans(); err != nil {
+				errs = append(errs, fmt.Errorf("target [%s]: %w", target.name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,445 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	defaultPartSizeBytes     = 64 << 20
+	defaultPartConcurrency   = 4
+	defaultUploadStateFile   = "./file/.upload-state.json"
+	defaultAbortOrphansAfter = 24 * time.Hour
+	maxUploadParts           = 10000
+)
+
+// PendingUpload is an upload interrupted before it completed.
+type PendingUpload struct {
+	FilePath   string
+	RemotePath string
+	Metadata   Metadata
+	// Uploader is the one to resume the upload with, which may be a single target of a MultiUploader.
+	Uploader Uploader
+}
+
+// Resumer is implemented by uploaders that keep interrupted uploads across restarts.
+type Resumer interface {
+	// Interrupted returns the uploads left unfinished by a previous run, to be passed to their Uploader again.
+	Interrupted() []PendingUpload
+	// AbortOrphans cleans up remote partial uploads that can no longer be resumed.
+	AbortOrphans() error
+}
+
+type completedPart struct {
+	PartNumber     int32  `json:"part_number"`
+	ETag           string `json:"etag"`
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+}
+
+// multipartUpload records the progress of one multipart upload. It is only resumed
+// if the local file is unchanged and the part size is the same, or if it was started while
+// the file was written, in which case the parts uploaded so far cover the start of the file.
+type multipartUpload struct {
+	UploadId  string          `json:"upload_id"`
+	FilePath  string          `json:"file_path"`
+	FileSize  int64           `json:"file_size"`
+	ModTime   time.Time       `json:"mod_time"`
+	PartSize  int64           `json:"part_size"`
+	Checksum  bool            `json:"checksum,omitempty"`
+	Metadata  Metadata        `json:"metadata"`
+	Parts     []completedPart `json:"parts"`
+	CreatedAt time.Time       `json:"created_at"`
+	Live      bool            `json:"live,omitempty"`
+}
+
+// uploadState persists in-progress multipart uploads, keyed by remote path.
+type uploadState struct {
+	mu      sync.Mutex
+	path    string
+	uploads map[string]*multipartUpload
+}
+
+func loadUploadState(path string) (*uploadState, error) {
+	state := &uploadState{path: path, uploads: make(map[string]*multipartUpload)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state.uploads)
+}
+
+func (s *uploadState) get(remotePath string) *multipartUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads[remotePath]
+}
+
+func (s *uploadState) put(remotePath string, upload *multipartUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[remotePath] = upload
+	s.persistLocked()
+}
+
+func (s *uploadState) addPart(remotePath string, part completedPart) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if upload, ok := s.uploads[remotePath]; ok {
+		upload.Parts = append(upload.Parts, part)
+		s.persistLocked()
+	}
+}
+
+// parts returns a copy of the parts uploaded so far.
+func (s *uploadState) parts(remotePath string) []completedPart {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if upload, ok := s.uploads[remotePath]; ok {
+		return append([]completedPart(nil), upload.Parts...)
+	}
+	return nil
+}
+
+func (s *uploadState) remove(remotePath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, remotePath)
+	s.persistLocked()
+}
+
+// snapshot returns a copy of the in-progress uploads by remote path.
+func (s *uploadState) snapshot() map[string]multipartUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uploads := make(map[string]multipartUpload, len(s.uploads))
+	for remotePath, upload := range s.uploads {
+		uploads[remotePath] = *upload
+	}
+	return uploads
+}
+
+func (s *uploadState) persistLocked() {
+	data, err := json.MarshalIndent(s.uploads, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode upload state: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		log.Printf("Failed to create folder for upload state %s: %v", s.path, err)
+		return
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0664); err != nil {
+		log.Printf("Failed to write upload state %s: %v", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		log.Printf("Failed to replace upload state %s: %v", s.path, err)
+	}
+}
+
+// partSizeFor grows the configured part size if needed to stay within the part count limit.
+func (u *S3Uploader) partSizeFor(fileSize int64) int64 {
+	partSize := u.partSize
+	if minPartSize := (fileSize + maxUploadParts - 1) / maxUploadParts; partSize < minPartSize {
+		partSize = minPartSize
+	}
+	return partSize
+}
+
+// uploadMultipart uploads the file in parts, resuming a previous upload of the same file if there is one.
+// The upload is kept in the state file until it completes, so a failed upload resumes on the next attempt.
+func (u *S3Uploader) uploadMultipart(file *os.File, fileInfo os.FileInfo, remotePath string, metadata Metadata) error {
+	ctx := context.Background()
+	partSize := u.partSizeFor(fileInfo.Size())
+
+	var upload *multipartUpload
+	if known := u.state.get(remotePath); known != nil {
+		resumed := *known
+		upload = &resumed
+	}
+	if upload != nil && upload.Live && upload.FilePath == file.Name() &&
+		(fileInfo.Size()+upload.PartSize-1)/upload.PartSize <= maxUploadParts {
+		// The file is finished now; upload the rest of it with the part size used while it was written.
+		partSize = upload.PartSize
+		upload.FileSize, upload.ModTime, upload.Live = fileInfo.Size(), fileInfo.ModTime(), false
+	}
+	if upload != nil && (upload.Live || upload.FilePath != file.Name() || upload.FileSize != fileInfo.Size() ||
+		!upload.ModTime.Equal(fileInfo.ModTime()) || upload.PartSize != partSize ||
+		upload.Checksum != (u.checksumAlgorithm() != "")) {
+		log.Printf("Local file changed since the interrupted upload of %s; starting over", remotePath)
+		u.abort(remotePath, upload.UploadId)
+		upload = nil
+	}
+
+	if upload != nil {
+		parts, err := u.listParts(ctx, remotePath, upload.UploadId)
+		var noSuchUpload *types.NoSuchUpload
+		if errors.As(err, &noSuchUpload) {
+			log.Printf("Interrupted upload of %s no longer exists; starting over", remotePath)
+			u.state.remove(remotePath)
+			upload = nil
+		} else if err != nil {
+			return err
+		} else {
+			upload.Parts = parts
+			u.state.put(remotePath, upload)
+			log.Printf("Resuming upload of %s with %d part(s) already uploaded", remotePath, len(parts))
+		}
+	}
+
+	if upload == nil {
+		output, err := u.client.CreateMultipartUpload(ctx, u.createMultipartInput(file.Name(), remotePath, metadata))
+		if err != nil {
+			return err
+		}
+		upload = &multipartUpload{
+			UploadId:  aws.ToString(output.UploadId),
+			FilePath:  file.Name(),
+			FileSize:  fileInfo.Size(),
+			ModTime:   fileInfo.ModTime(),
+			PartSize:  partSize,
+			Checksum:  u.checksumAlgorithm() != "",
+			Metadata:  metadata,
+			CreatedAt: time.Now(),
+		}
+		u.state.put(remotePath, upload)
+	}
+
+	if err := u.uploadParts(ctx, file, remotePath, upload); err != nil {
+		return err
+	}
+
+	if err := u.completeMultipart(ctx, remotePath, upload.UploadId, u.state.parts(remotePath)); err != nil {
+		return err
+	}
+	u.state.remove(remotePath)
+	return nil
+}
+
+func (u *S3Uploader) createMultipartInput(filePath, remotePath string, metadata Metadata) *s3.CreateMultipartUploadInput {
+	return &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(u.bucket),
+		Key:                  u.key(remotePath),
+		ContentType:          aws.String(contentType(filePath)),
+		Metadata:             metadata.objectMetadata(),
+		StorageClass:         u.storageClass,
+		ServerSideEncryption: u.sse,
+		SSEKMSKeyId:          u.kmsKeyId(),
+		ChecksumAlgorithm:    u.checksumAlgorithm(),
+	}
+}
+
+// completeMultipart assembles the object from the given parts.
+func (u *S3Uploader) completeMultipart(ctx context.Context, remotePath, uploadId string, parts []completedPart) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completedPart := types.CompletedPart{
+			PartNumber: aws.Int32(part.PartNumber),
+			ETag:       aws.String(part.ETag),
+		}
+		if part.ChecksumSHA256 != "" {
+			completedPart.ChecksumSHA256 = aws.String(part.ChecksumSHA256)
+		}
+		completed = append(completed, completedPart)
+	}
+	_, err := u.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.bucket),
+		Key:             u.key(remotePath),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+// uploadParts uploads the parts not uploaded yet, u.concurrency at a time.
+func (u *S3Uploader) uploadParts(ctx context.Context, file *os.File, remotePath string, upload *multipartUpload) error {
+	done := make(map[int32]bool, len(upload.Parts))
+	for _, part := range upload.Parts {
+		done[part.PartNumber] = true
+	}
+
+	partCount := int32((upload.FileSize + upload.PartSize - 1) / upload.PartSize)
+	partNumbers := make(chan int32)
+	errs := make(chan error, partCount)
+	var wg sync.WaitGroup
+	for i := 0; i < u.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range partNumbers {
+				offset := int64(partNumber-1) * upload.PartSize
+				length := min(upload.PartSize, upload.FileSize-offset)
+				if err := u.uploadPart(ctx, file, remotePath, upload, partNumber, length); err != nil {
+					errs <- fmt.Errorf("part %d/%d: %w", partNumber, partCount, err)
+				}
+			}
+		}()
+	}
+
+	for partNumber := int32(1); partNumber <= partCount; partNumber++ {
+		if !done[partNumber] {
+			partNumbers <- partNumber
+		}
+	}
+	close(partNumbers)
+	wg.Wait()
+	close(errs)
+
+	var failed []error
+	for err := range errs {
+		failed = append(failed, err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d part(s) failed, upload can be resumed: %w", len(failed), errors.Join(failed...))
+	}
+	return nil
+}
+
+// uploadPart uploads length bytes of the given part and records it in the state file.
+func (u *S3Uploader) uploadPart(ctx context.Context, file *os.File, remotePath string, upload *multipartUpload, partNumber int32, length int64) error {
+	output, err := u.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:            aws.String(u.bucket),
+		Key:               u.key(remotePath),
+		UploadId:          aws.String(upload.UploadId),
+		PartNumber:        aws.Int32(partNumber),
+		Body:              io.NewSectionReader(file, int64(partNumber-1)*upload.PartSize, length),
+		ContentLength:     aws.Int64(length),
+		ChecksumAlgorithm: u.checksumAlgorithm(),
+	})
+	if err != nil {
+		return err
+	}
+	uploadedBytes.WithLabelValues(u.backend).Add(float64(length))
+	u.state.addPart(remotePath, completedPart{
+		PartNumber:     partNumber,
+		ETag:           aws.ToString(output.ETag),
+		ChecksumSHA256: aws.ToString(output.ChecksumSHA256),
+	})
+	return nil
+}
+
+func (u *S3Uploader) listParts(ctx context.Context, remotePath, uploadId string) ([]completedPart, error) {
+	var parts []completedPart
+	paginator := s3.NewListPartsPaginator(u.client, &s3.ListPartsInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      u.key(remotePath),
+		UploadId: aws.String(uploadId),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			parts = append(parts, completedPart{
+				PartNumber:     aws.ToInt32(part.PartNumber),
+				ETag:           aws.ToString(part.ETag),
+				ChecksumSHA256: aws.ToString(part.ChecksumSHA256),
+			})
+		}
+	}
+	return parts, nil
+}
+
+func (u *S3Uploader) abort(remotePath, uploadId string) {
+	_, err := u.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      u.key(remotePath),
+		UploadId: aws.String(uploadId),
+	})
+	if err != nil {
+		log.Printf("Failed to abort multipart upload of %s: %v", remotePath, err)
+	}
+	u.state.remove(remotePath)
+}
+
+// Interrupted returns the unfinished uploads, except for those of files still being recorded.
+func (u *S3Uploader) Interrupted() []PendingUpload {
+	var pending []PendingUpload
+	for remotePath, upload := range u.state.snapshot() {
+		if _, running := u.running.Load(remotePath); running {
+			continue
+		}
+		pending = append(pending, PendingUpload{
+			FilePath:   upload.FilePath,
+			RemotePath: remotePath,
+			Metadata:   upload.Metadata,
+			Uploader:   u,
+		})
+	}
+	return pending
+}
+
+// AbortOrphans aborts interrupted uploads whose local file is gone, and multipart uploads under the prefix
+// unknown to the state file and older than the configured age, which would otherwise be billed forever.
+// Uploads started live are completed with the parts that reached the bucket instead, keeping what was recorded.
+// Without a prefix the bucket may be shared with others, so it is not searched for unknown uploads.
+func (u *S3Uploader) AbortOrphans() error {
+	known := make(map[string]bool)
+	for remotePath, upload := range u.state.snapshot() {
+		if _, running := u.running.Load(remotePath); running {
+			known[upload.UploadId] = true
+			continue
+		}
+		if _, err := os.Stat(upload.FilePath); os.IsNotExist(err) && upload.Live {
+			log.Printf("Completing live upload of %s with the parts uploaded; %s no longer exists", remotePath, upload.FilePath)
+			if err := u.completeUploaded(remotePath, upload); err != nil {
+				log.Printf("Failed to complete live upload of %s: %v", remotePath, err)
+				known[upload.UploadId] = true
+			}
+			continue
+		} else if os.IsNotExist(err) {
+			log.Printf("Aborting interrupted upload of %s; %s no longer exists", remotePath, upload.FilePath)
+			u.abort(remotePath, upload.UploadId)
+			continue
+		}
+		known[upload.UploadId] = true
+	}
+
+	if u.prefix == "" {
+		return nil
+	}
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(u.bucket), Prefix: aws.String(u.prefix)}
+	for {
+		page, err := u.client.ListMultipartUploads(context.Background(), input)
+		if err != nil {
+			return err
+		}
+		for _, upload := range page.Uploads {
+			uploadId, remotePath := aws.ToString(upload.UploadId), aws.ToString(upload.Key)
+			if known[uploadId] || time.Since(aws.ToTime(upload.Initiated)) < u.abortOrphansAfter {
+				continue
+			}
+			log.Printf("Aborting orphaned multipart upload of %s started at %s", remotePath, aws.ToTime(upload.Initiated))
+			_, err := u.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(u.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				log.Printf("Failed to abort multipart upload of %s: %v", remotePath, err)
+			}
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			return nil
+		}
+		input.KeyMarker, input.UploadIdMarker = page.NextKeyMarker, page.NextUploadIdMarker
+	}
+}
@@ -0,0 +1,249 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config" // AWS SDK config
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	appconfig "github.com/jzhang046/croned-twitcasting-recorder-mp4/config" // Our app's config
+)
+
+const r2Region = "auto"
+
+type Uploader interface {
+	Upload(filePath, remotePath string, metadata Metadata) error
+}
+
+// Fetcher is implemented by uploaders that can read uploaded objects back.
+type Fetcher interface {
+	Fetch(remotePath string) (io.ReadCloser, error)
+}
+
+// Deleter is implemented by uploaders that may want local files removed once they are uploaded.
+type Deleter interface {
+	DeletesAfterUpload() bool
+}
+
+// fileRouter is implemented by uploaders passing files on to others, depending on the metadata of each file.
+type fileRouter interface {
+	deletesAfterUpload(metadata Metadata) bool
+	verify(filePath, remotePath string, metadata Metadata) error
+}
+
+// DeletesAfterUpload reports whether the local file described by metadata should be removed once uploaded by u.
+func DeletesAfterUpload(u Uploader, metadata Metadata) bool {
+	if router, ok := u.(fileRouter); ok {
+		return router.deletesAfterUpload(metadata)
+	}
+	deleter, ok := u.(Deleter)
+	return ok && deleter.DeletesAfterUpload()
+}
+
+// S3Uploader uploads to any S3-compatible storage, such as AWS S3, Cloudflare R2, MinIO, Backblaze B2 or Wasabi.
+type S3Uploader struct {
+	backend           string
+	client            *s3.Client
+	bucket            string
+	prefix            string
+	storageClass      types.StorageClass
+	sse               types.ServerSideEncryption
+	sseKMSKeyID       string
+	partSize          int64
+	concurrency       int
+	abortOrphansAfter time.Duration
+	live              bool
+	livePartSize      int64
+	running           sync.Map // Remote paths uploaded live right now
+	state             *uploadState
+	deleteAfterUpload bool
+	limits            *Limits
+}
+
+// NewR2Uploader creates an S3Uploader for Cloudflare R2, whose region is always "auto".
+func NewR2Uploader(cfg *appconfig.S3Config, limits *Limits) (*S3Uploader, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, errors.New("R2 configuration is not enabled")
+	}
+	r2Cfg := *cfg
+	if r2Cfg.Region == "" {
+		r2Cfg.Region = r2Region
+	}
+	u, err := NewS3Uploader(&r2Cfg, limits)
+	if err != nil {
+		return nil, err
+	}
+	u.backend = backendR2
+	return u, nil
+}
+
+func NewS3Uploader(cfg *appconfig.S3Config, limits *Limits) (*S3Uploader, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, errors.New("S3 configuration is not enabled")
+	}
+
+	// Only send checksums when required, as not every S3-compatible service accepts them.
+	loadOptions := []func(*config.LoadOptions) error{
+		config.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired),
+		config.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
+	}
+	if cfg.Region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(cfg.Region))
+	}
+	if cfg.AccessKeyID != "" {
+		loadOptions = append(loadOptions, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		))
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(context.Background(), loadOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.PathStyle
+		if bandwidth := limits.bandwidth(cfg.BandwidthLimitKB); bandwidth != nil {
+			o.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+				tr.DialContext = bandwidth.dialContext(tr.DialContext)
+			})
+		}
+	})
+
+	u := &S3Uploader{
+		backend:           backendS3,
+		client:            client,
+		bucket:            cfg.Bucket,
+		storageClass:      types.StorageClass(cfg.StorageClass),
+		sse:               types.ServerSideEncryption(cfg.SSE),
+		sseKMSKeyID:       cfg.SSEKMSKeyID,
+		partSize:          defaultPartSizeBytes,
+		concurrency:       defaultPartConcurrency,
+		abortOrphansAfter: defaultAbortOrphansAfter,
+		live:              cfg.LiveUpload,
+		livePartSize:      defaultLivePartSizeBytes,
+		deleteAfterUpload: cfg.DeleteAfterUpload,
+		limits:            limits,
+	}
+	if prefix := strings.Trim(cfg.Prefix, "/"); prefix != "" {
+		u.prefix = prefix + "/"
+	}
+	if cfg.PartSizeMB > 0 {
+		u.partSize = int64(cfg.PartSizeMB) << 20
+	}
+	if cfg.Concurrency > 0 {
+		u.concurrency = cfg.Concurrency
+	}
+	if cfg.LivePartSizeMB > 0 {
+		u.livePartSize = int64(cfg.LivePartSizeMB) << 20
+	}
+	if cfg.AbortOrphansAfter > 0 {
+		u.abortOrphansAfter = cfg.AbortOrphansAfter
+	}
+	stateFile := defaultUploadStateFile
+	if cfg.StateFile != "" {
+		stateFile = cfg.StateFile
+	}
+	if u.state, err = loadUploadState(stateFile); err != nil {
+		log.Printf("Failed to load upload state %s: %v", stateFile, err)
+	}
+	return u, nil
+}
+
+// key returns the object key of remotePath, under the configured prefix.
+func (u *S3Uploader) key(remotePath string) *string {
+	return aws.String(u.prefix + remotePath)
+}
+
+func (u *S3Uploader) kmsKeyId() *string {
+	if u.sseKMSKeyID == "" {
+		return nil
+	}
+	return aws.String(u.sseKMSKeyID)
+}
+
+// checksumAlgorithm asks for SHA-256 checksums to be stored with objects that are verified before
+// local files are deleted; otherwise checksums are left out for services that do not support them.
+func (u *S3Uploader) checksumAlgorithm() types.ChecksumAlgorithm {
+	if u.deleteAfterUpload {
+		return types.ChecksumAlgorithmSha256
+	}
+	return ""
+}
+
+func (u *S3Uploader) DeletesAfterUpload() bool {
+	return u.deleteAfterUpload
+}
+
+func (u *S3Uploader) Upload(filePath, remotePath string, metadata Metadata) error {
+	if err := u.limits.wait(filePath); err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Start uploading %s to s3://%s/%s%s", filePath, u.bucket, u.prefix, remotePath)
+
+	if fileInfo.Size() > u.partSize || u.liveUpload(remotePath) != nil {
+		err = u.uploadMultipart(file, fileInfo, remotePath, metadata)
+	} else {
+		_, err = u.client.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket:               aws.String(u.bucket),
+			Key:                  u.key(remotePath),
+			Body:                 file,
+			ContentType:          aws.String(contentType(filePath)),
+			Metadata:             metadata.objectMetadata(),
+			StorageClass:         u.storageClass,
+			ServerSideEncryption: u.sse,
+			SSEKMSKeyId:          u.kmsKeyId(),
+			ChecksumAlgorithm:    u.checksumAlgorithm(),
+		})
+		if err == nil {
+			uploadedBytes.WithLabelValues(u.backend).Add(float64(fileInfo.Size()))
+		}
+	}
+
+	if err != nil {
+		log.Printf("Failed to upload %s to s3://%s: %v", filepath.Base(filePath), u.bucket, err)
+		uploadFailures.WithLabelValues(u.backend).Inc()
+		return err
+	}
+
+	log.Printf("Completed uploading %s", filepath.Base(filePath))
+	return nil
+}
+
+func (u *S3Uploader) Fetch(remotePath string) (io.ReadCloser, error) {
+	output, err := u.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    u.key(remotePath),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
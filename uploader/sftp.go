@@ -0,0 +1,318 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	appconfig "github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sftpPasswordEnv       = "RECORDER_SFTP_PASSWORD"
+	defaultSFTPPort       = "22"
+	defaultSFTPRequests   = 64
+	partialSFTPFileSuffix = ".part"
+	// The size and modification time of the local file a partial file is written from are kept next to it.
+	partialSFTPSourceSuffix = ".part.source"
+)
+
+// SFTPUploader uploads to a folder on an SSH server. Uploads are written to a partial file first,
+// which is resumed from its current size if an upload of the same local file is interrupted.
+type SFTPUploader struct {
+	address     string
+	root        string
+	sshConfig   *ssh.ClientConfig
+	concurrency int
+	bandwidth   *bandwidth
+
+	deleteAfterUpload bool
+	limits            *Limits
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func NewSFTPUploader(cfg *appconfig.SFTPConfig, limits *Limits) (*SFTPUploader, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, errors.New("SFTP configuration is not enabled")
+	}
+
+	knownHostsPath := cfg.KnownHosts
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading known hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKey != "" {
+		signer, err := loadPrivateKey(cfg.PrivateKey, cfg.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("loading private key %s: %w", cfg.PrivateKey, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	password := cfg.Password
+	if password == "" {
+		password = os.Getenv(sftpPasswordEnv)
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("SFTP requires a private key or a password")
+	}
+
+	address := cfg.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, defaultSFTPPort)
+	}
+
+	u := &SFTPUploader{
+		address: address,
+		root:    cfg.Path,
+		sshConfig: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         cfg.Timeout,
+		},
+		concurrency: defaultSFTPRequests,
+		bandwidth:   limits.bandwidth(cfg.BandwidthLimitKB),
+
+		deleteAfterUpload: cfg.DeleteAfterUpload,
+		limits:            limits,
+	}
+	if cfg.Concurrency > 0 {
+		u.concurrency = cfg.Concurrency
+	}
+	return u, nil
+}
+
+func loadPrivateKey(keyPath, passphrase string) (ssh.Signer, error) {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
+	return ssh.ParsePrivateKey(key)
+}
+
+// connect returns the shared SFTP client, dialing the server if not connected.
+func (u *SFTPUploader) connect() (*sftp.Client, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.client != nil {
+		return u.client, nil
+	}
+	conn, err := u.dial()
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn,
+		sftp.UseConcurrentWrites(true),
+		sftp.MaxConcurrentRequestsPerFile(u.concurrency),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	u.conn, u.client = conn, client
+	return client, nil
+}
+
+// dial opens the SSH connection, as ssh.Dial does, with writes throttled if uploads are limited.
+func (u *SFTPUploader) dial() (*ssh.Client, error) {
+	dialer := &net.Dialer{Timeout: u.sshConfig.Timeout}
+	netConn, err := u.bandwidth.dialContext(dialer.DialContext)(context.Background(), "tcp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, u.address, u.sshConfig)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// disconnectIfBroken drops the connection once it stops responding, so that the next upload dials again.
+// Other uploads may share the connection, so it is kept if the failure was specific to one file.
+func (u *SFTPUploader) disconnectIfBroken(client *sftp.Client) {
+	if _, err := client.Getwd(); err == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.client != client {
+		return
+	}
+	u.client.Close()
+	u.conn.Close()
+	u.conn, u.client = nil, nil
+}
+
+func (u *SFTPUploader) targetPath(remotePath string) string {
+	return path.Join(u.root, remotePath)
+}
+
+func (u *SFTPUploader) Upload(filePath, remotePath string, metadata Metadata) error {
+	if err := u.limits.wait(filePath); err != nil {
+		return err
+	}
+
+	targetPath := u.targetPath(remotePath)
+	log.Printf("Start uploading %s to sftp://%s%s", filePath, u.address, targetPath)
+
+	client, err := u.connect()
+	if err == nil {
+		err = u.upload(client, filePath, targetPath)
+		if err != nil {
+			u.disconnectIfBroken(client)
+		}
+	}
+	uploadDone(backendSFTP, filePath, err)
+	if err != nil {
+		log.Printf("Failed to upload %s to SFTP: %v", filepath.Base(filePath), err)
+		return err
+	}
+
+	log.Printf("Completed uploading %s", filepath.Base(filePath))
+	return nil
+}
+
+func (u *SFTPUploader) upload(client *sftp.Client, filePath, targetPath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := client.MkdirAll(path.Dir(targetPath)); err != nil {
+		return fmt.Errorf("creating remote folder: %w", err)
+	}
+
+	partialPath := targetPath + partialSFTPFileSuffix
+	remoteFile, err := client.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer remoteFile.Close()
+
+	// Resume from the partial file's size if it was written from this very local file and is not longer.
+	sourcePath, source := targetPath+partialSFTPSourceSuffix, sourceStamp(fileInfo)
+	offset := int64(0)
+	if stamp, err := readRemoteFile(client, sourcePath); err == nil && string(stamp) == source {
+		if partialInfo, err := remoteFile.Stat(); err == nil && partialInfo.Size() <= fileInfo.Size() {
+			offset = partialInfo.Size()
+		}
+	}
+	if offset > 0 {
+		log.Printf("Resuming upload of %s from %d bytes", filepath.Base(filePath), offset)
+	} else {
+		if err := remoteFile.Truncate(0); err != nil {
+			return err
+		}
+		if err := writeRemoteFile(client, sourcePath, []byte(source)); err != nil {
+			return fmt.Errorf("recording source of partial file: %w", err)
+		}
+	}
+	if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := remoteFile.ReadFrom(io.NewSectionReader(file, offset, fileInfo.Size()-offset)); err != nil {
+		return err
+	}
+	if err := remoteFile.Close(); err != nil {
+		return err
+	}
+
+	partialInfo, err := client.Stat(partialPath)
+	if err != nil {
+		return err
+	}
+	if partialInfo.Size() != fileInfo.Size() {
+		return fmt.Errorf("uploaded size %d does not match local size %d", partialInfo.Size(), fileInfo.Size())
+	}
+
+	if err := client.PosixRename(partialPath, targetPath); err != nil {
+		// Servers without the posix-rename extension cannot rename over an existing file.
+		client.Remove(targetPath)
+		if err := client.Rename(partialPath, targetPath); err != nil {
+			return err
+		}
+	}
+	if err := client.Remove(sourcePath); err != nil {
+		log.Printf("Failed to remove %s: %v", sourcePath, err)
+	}
+	if err := client.Chtimes(targetPath, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+		log.Printf("Failed to keep modification time of %s: %v", targetPath, err)
+	}
+	return nil
+}
+
+// sourceStamp identifies the content of a local file by its size and modification time.
+func sourceStamp(fileInfo os.FileInfo) string {
+	return fmt.Sprintf("%d %d", fileInfo.Size(), fileInfo.ModTime().UnixNano())
+}
+
+func readRemoteFile(client *sftp.Client, remotePath string) ([]byte, error) {
+	file, err := client.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func writeRemoteFile(client *sftp.Client, remotePath string, data []byte) error {
+	file, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (u *SFTPUploader) Fetch(remotePath string) (io.ReadCloser, error) {
+	client, err := u.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(u.targetPath(remotePath))
+}
+
+func (u *SFTPUploader) DeletesAfterUpload() bool {
+	return u.deleteAfterUpload
+}
@@ -0,0 +1,260 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	appconfig "github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+const (
+	testSFTPUser     = "recorder"
+	testSFTPPassword = "secret"
+)
+
+// sftpServer is an in-process SSH server serving the local filesystem over SFTP.
+type sftpServer struct {
+	address string
+	hostKey ssh.PublicKey
+	root    string
+}
+
+func newSFTPServer(t *testing.T) *sftpServer {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == testSFTPUser && string(password) == testSFTPPassword {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+
+	return &sftpServer{address: listener.Addr().String(), hostKey: signer.PublicKey(), root: t.TempDir()}
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				isSFTP := req.Type == "subsystem" && len(req.Payload) > 4 &&
+					string(req.Payload[4:4+binary.BigEndian.Uint32(req.Payload)]) == "sftp"
+				req.Reply(isSFTP, nil)
+				if isSFTP {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					server.Serve()
+					server.Close()
+					return
+				}
+			}
+		}()
+	}
+}
+
+// knownHosts writes a known_hosts file trusting the given host key for the server's address.
+func (s *sftpServer) knownHosts(t *testing.T, hostKey ssh.PublicKey) string {
+	t.Helper()
+	knownHostsPath := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.address)}, hostKey)
+	if err := os.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return knownHostsPath
+}
+
+func (s *sftpServer) uploader(t *testing.T) *SFTPUploader {
+	t.Helper()
+	u, err := NewSFTPUploader(&appconfig.SFTPConfig{
+		Enabled:    true,
+		Host:       s.address,
+		User:       testSFTPUser,
+		Password:   testSFTPPassword,
+		Path:       s.root,
+		KnownHosts: s.knownHosts(t, s.hostKey),
+		Timeout:    5 * time.Second,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestSFTPUpload(t *testing.T) {
+	server := newSFTPServer(t)
+	u := server.uploader(t)
+
+	filePath, data := writeTestFile(t, "capture.ts", 300<<10)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Upload(filePath, "streamer/2026/capture.ts", Metadata{}); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	targetPath := filepath.Join(server.root, "streamer", "2026", "capture.ts")
+	if got, err := os.ReadFile(targetPath); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file does not match the source: %v", err)
+	}
+	if info, err := os.Stat(targetPath); err != nil || !info.ModTime().Equal(modTime) {
+		t.Fatalf("uploaded file modification time is not kept: %v", err)
+	}
+	for _, suffix := range []string{partialSFTPFileSuffix, partialSFTPSourceSuffix} {
+		if _, err := os.Stat(targetPath + suffix); !os.IsNotExist(err) {
+			t.Fatalf("%s left behind", suffix)
+		}
+	}
+
+	fetched, err := u.Fetch("streamer/2026/capture.ts")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	defer fetched.Close()
+	if got, _ := io.ReadAll(fetched); !bytes.Equal(got, data) {
+		t.Fatal("fetched file does not match the source")
+	}
+}
+
+func TestSFTPUploadResumesPartialFile(t *testing.T) {
+	server := newSFTPServer(t)
+	u := server.uploader(t)
+
+	filePath, data := writeTestFile(t, "capture.ts", 200<<10)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetPath := filepath.Join(server.root, "capture.ts")
+	// The partial file holds the first half of the source, with a mark that only the resumed upload can tell
+	// apart from a fresh one.
+	partial := append([]byte{}, data[:100<<10]...)
+	partial[0] ^= 0xff
+	if err := os.WriteFile(targetPath+partialSFTPFileSuffix, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(targetPath+partialSFTPSourceSuffix, []byte(sourceStamp(info)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.Upload(filePath, "capture.ts", Metadata{}); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	got, err := os.ReadFile(targetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[1:], data[1:]) || got[0] != partial[0] {
+		t.Fatal("upload was not resumed from the partial file")
+	}
+}
+
+func TestSFTPUploadRestartsPartialFileOfOtherSource(t *testing.T) {
+	server := newSFTPServer(t)
+	u := server.uploader(t)
+
+	filePath, data := writeTestFile(t, "capture.ts", 200<<10)
+	targetPath := filepath.Join(server.root, "capture.ts")
+	stale := bytes.Repeat([]byte{0xaa}, 150<<10)
+	if err := os.WriteFile(targetPath+partialSFTPFileSuffix, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(targetPath+partialSFTPSourceSuffix, []byte("153600 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.Upload(filePath, "capture.ts", Metadata{}); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got, err := os.ReadFile(targetPath); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file does not match the source: %v", err)
+	}
+}
+
+func TestSFTPUploadRejectsUnknownHostKey(t *testing.T) {
+	server := newSFTPServer(t)
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, err := ssh.NewPublicKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewSFTPUploader(&appconfig.SFTPConfig{
+		Enabled:    true,
+		Host:       server.address,
+		User:       testSFTPUser,
+		Password:   testSFTPPassword,
+		Path:       server.root,
+		KnownHosts: server.knownHosts(t, otherPublicKey),
+		Timeout:    5 * time.Second,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath, _ := writeTestFile(t, "capture.ts", 1024)
+	err = u.Upload(filePath, "capture.ts", Metadata{})
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("Upload with a mismatching host key returned %v, want a host key error", err)
+	}
+	if _, statErr := os.Stat(filepath.Join(server.root, "capture.ts")); !os.IsNotExist(statErr) {
+		t.Fatal("file was uploaded to a server with an unknown host key")
+	}
+}
@@ -0,0 +1,217 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	// md5ETag matches ETags that are an MD5 digest, optionally of the parts of a multipart upload.
+	md5ETag = regexp.MustCompile(`^[0-9a-f]{32}(-\d+)?$`)
+	// partCountSuffix ends the checksums and ETags of objects uploaded in parts.
+	partCountSuffix = regexp.MustCompile(`-\d+$`)
+)
+
+// Verifier is implemented by uploaders that can confirm an uploaded file matches the local one.
+type Verifier interface {
+	Verify(filePath, remotePath string) error
+}
+
+// VerifyUpload confirms that the upload of filePath by u matches the local file. For a MultiUploader,
+// the file is verified on every target it was delivered to.
+func VerifyUpload(u Uploader, filePath, remotePath string, metadata Metadata) error {
+	if router, ok := u.(fileRouter); ok {
+		return router.verify(filePath, remotePath, metadata)
+	}
+	verifier, ok := u.(Verifier)
+	if !ok {
+		return errors.New("the uploader cannot verify uploads")
+	}
+	return verifier.Verify(filePath, remotePath)
+}
+
+// verifyByFetch reads the uploaded file back and compares its size and SHA-256 with the local file.
+func verifyByFetch(fetcher Fetcher, filePath, remotePath string) error {
+	localSize, localDigest, err := hashFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	remote, err := fetcher.Fetch(remotePath)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	hasher := sha256.New()
+	remoteSize, err := io.Copy(hasher, remote)
+	if err != nil {
+		return err
+	}
+	if remoteSize != localSize {
+		return fmt.Errorf("remote size %d does not match local size %d", remoteSize, localSize)
+	}
+	if !bytes.Equal(hasher.Sum(nil), localDigest) {
+		return fmt.Errorf("remote checksum does not match local file")
+	}
+	return nil
+}
+
+func hashFile(filePath string) (int64, []byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return 0, nil, err
+	}
+	return size, hasher.Sum(nil), nil
+}
+
+// Verify compares the object's size, and its SHA-256 checksum or MD5 ETag, with the local file.
+// Both are computed the way S3 does for the part size the file was uploaded with, which is read from
+// the object's first part, as files uploaded live use a part size of their own.
+func (u *S3Uploader) Verify(filePath, remotePath string) error {
+	head, err := u.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket:       aws.String(u.bucket),
+		Key:          u.key(remotePath),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if remoteSize := aws.ToInt64(head.ContentLength); remoteSize != fileInfo.Size() {
+		return fmt.Errorf("remote size %d does not match local size %d", remoteSize, fileInfo.Size())
+	}
+
+	checksum, etag := aws.ToString(head.ChecksumSHA256), strings.Trim(aws.ToString(head.ETag), `"`)
+	multipart := partCountSuffix.MatchString(checksum) || partCountSuffix.MatchString(etag)
+	partSize := u.partSizeFor(fileInfo.Size())
+	if multipart {
+		if firstPartSize, err := u.firstPartSize(remotePath); err == nil {
+			partSize = firstPartSize
+		}
+	}
+	digests, err := partDigests(filePath, partSize)
+	if err != nil {
+		return err
+	}
+
+	if checksum != "" {
+		if expected := digests.checksumSHA256(multipart); checksum != expected {
+			return fmt.Errorf("remote checksum %s does not match local %s", checksum, expected)
+		}
+		return nil
+	}
+	if md5ETag.MatchString(etag) {
+		if expected := digests.etag(multipart); etag != expected {
+			return fmt.Errorf("remote ETag %s does not match local %s", etag, expected)
+		}
+		return nil
+	}
+	return fmt.Errorf("remote object has neither a SHA-256 checksum nor an MD5 ETag to compare")
+}
+
+func (u *S3Uploader) firstPartSize(remotePath string) (int64, error) {
+	head, err := u.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket:     aws.String(u.bucket),
+		Key:        u.key(remotePath),
+		PartNumber: aws.Int32(1),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return aws.ToInt64(head.ContentLength), nil
+}
+
+// fileDigests holds the SHA-256 and MD5 digests of a file as a whole and of each of its parts.
+type fileDigests struct {
+	sha256, md5           []byte
+	partSHA256s, partMD5s [][]byte
+}
+
+func partDigests(filePath string, partSize int64) (*fileDigests, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	wholeSHA256, wholeMD5 := sha256.New(), md5.New()
+	digests := &fileDigests{}
+	for {
+		partSHA256, partMD5 := sha256.New(), md5.New()
+		n, err := io.CopyN(io.MultiWriter(wholeSHA256, wholeMD5, partSHA256, partMD5), file, partSize)
+		if n > 0 {
+			digests.partSHA256s = append(digests.partSHA256s, partSHA256.Sum(nil))
+			digests.partMD5s = append(digests.partMD5s, partMD5.Sum(nil))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	digests.sha256, digests.md5 = wholeSHA256.Sum(nil), wholeMD5.Sum(nil)
+	return digests, nil
+}
+
+// checksumSHA256 returns the x-amz-checksum-sha256 value: the file's digest, or for a multipart upload,
+// the digest of the part digests followed by the part count.
+func (d *fileDigests) checksumSHA256(multipart bool) string {
+	if !multipart {
+		return base64.StdEncoding.EncodeToString(d.sha256)
+	}
+	composite := sha256.New()
+	for _, part := range d.partSHA256s {
+		composite.Write(part)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(composite.Sum(nil)), len(d.partSHA256s))
+}
+
+// etag returns the ETag S3 assigns to unencrypted objects, built from MD5 digests the same way.
+func (d *fileDigests) etag(multipart bool) string {
+	if !multipart {
+		return hex.EncodeToString(d.md5)
+	}
+	composite := md5.New()
+	for _, part := range d.partMD5s {
+		composite.Write(part)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(composite.Sum(nil)), len(d.partMD5s))
+}
+
+func (u *LocalUploader) Verify(filePath, remotePath string) error {
+	return verifyByFetch(u, filePath, remotePath)
+}
+
+func (u *WebDAVUploader) Verify(filePath, remotePath string) error {
+	return verifyByFetch(u, filePath, remotePath)
+}
+
+func (u *SFTPUploader) Verify(filePath, remotePath string) error {
+	return verifyByFetch(u, filePath, remotePath)
+}
@@ -0,0 +1,313 @@
+package uploader
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	appconfig "github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+const (
+	webdavUsernameEnv = "RECORDER_WEBDAV_USERNAME"
+	webdavPasswordEnv = "RECORDER_WEBDAV_PASSWORD"
+)
+
+// WebDAVUploader uploads to a WebDAV folder, such as one on Nextcloud.
+type WebDAVUploader struct {
+	client    *http.Client
+	baseURL   string
+	username  string
+	password  string
+	chunkURL  string
+	chunkSize int64
+
+	deleteAfterUpload bool
+	limits            *Limits
+
+	mu          sync.Mutex
+	createdDirs map[string]bool
+}
+
+func NewWebDAVUploader(cfg *appconfig.WebDAVConfig, limits *Limits) (*WebDAVUploader, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, errors.New("WebDAV configuration is not enabled")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = limits.bandwidth(cfg.BandwidthLimitKB).dialContext(transport.DialContext)
+	u := &WebDAVUploader{
+		client:      &http.Client{Transport: transport},
+		baseURL:     strings.TrimSuffix(cfg.URL, "/"),
+		username:    cfg.Username,
+		password:    cfg.Password,
+		chunkURL:    strings.TrimSuffix(cfg.ChunkURL, "/"),
+		chunkSize:   int64(cfg.ChunkSizeMB) << 20,
+		createdDirs: make(map[string]bool),
+
+		deleteAfterUpload: cfg.DeleteAfterUpload,
+		limits:            limits,
+	}
+	if u.username == "" {
+		u.username = os.Getenv(webdavUsernameEnv)
+	}
+	if u.password == "" {
+		u.password = os.Getenv(webdavPasswordEnv)
+	}
+	return u, nil
+}
+
+// remoteURL returns the URL of remotePath under the base folder, with each segment escaped.
+func (u *WebDAVUploader) remoteURL(remotePath string) string {
+	segments := strings.Split(strings.Trim(remotePath, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return u.baseURL + "/" + strings.Join(segments, "/")
+}
+
+func (u *WebDAVUploader) Upload(filePath, remotePath string, metadata Metadata) error {
+	if err := u.limits.wait(filePath); err != nil {
+		return err
+	}
+	log.Printf("Start uploading %s to %s", filePath, u.remoteURL(remotePath))
+
+	err := u.upload(filePath, remotePath)
+	uploadDone(backendWebDAV, filePath, err)
+	if err != nil {
+		log.Printf("Failed to upload %s to WebDAV: %v", filepath.Base(filePath), err)
+		return err
+	}
+
+	log.Printf("Completed uploading %s", filepath.Base(filePath))
+	return nil
+}
+
+func (u *WebDAVUploader) upload(filePath, remotePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := u.makeDirs(path.Dir(strings.Trim(remotePath, "/"))); err != nil {
+		return err
+	}
+
+	if u.chunkURL != "" && u.chunkSize > 0 && fileInfo.Size() > u.chunkSize {
+		err = u.putChunked(file, fileInfo, remotePath)
+	} else {
+		err = u.put(u.remoteURL(remotePath), file, fileInfo.Size(), func(req *http.Request) {
+			req.Header.Set("Content-Type", contentType(filePath))
+			req.Header.Set("X-OC-Mtime", strconv.FormatInt(fileInfo.ModTime().Unix(), 10))
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	remoteSize, err := u.size(remotePath)
+	if err != nil {
+		return fmt.Errorf("checking uploaded size: %w", err)
+	}
+	if remoteSize != fileInfo.Size() {
+		return fmt.Errorf("uploaded size %d does not match local size %d", remoteSize, fileInfo.Size())
+	}
+	return nil
+}
+
+// makeDirs creates the folders of dir under the base folder, one MKCOL at a time.
+func (u *WebDAVUploader) makeDirs(dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+	current := ""
+	for _, segment := range strings.Split(dir, "/") {
+		current = path.Join(current, segment)
+
+		u.mu.Lock()
+		created := u.createdDirs[current]
+		u.mu.Unlock()
+		if created {
+			continue
+		}
+
+		req, err := u.newRequest("MKCOL", u.remoteURL(current), nil)
+		if err != nil {
+			return err
+		}
+		// 405 means the folder already exists.
+		if err := u.do(req, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return fmt.Errorf("creating folder %s: %w", current, err)
+		}
+
+		u.mu.Lock()
+		u.createdDirs[current] = true
+		u.mu.Unlock()
+	}
+	return nil
+}
+
+func (u *WebDAVUploader) put(targetURL string, body io.Reader, size int64, setHeaders func(*http.Request)) error {
+	req, err := u.newRequest(http.MethodPut, targetURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if setHeaders != nil {
+		setHeaders(req)
+	}
+	return u.do(req, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+}
+
+// putChunked uploads the file in chunks into a transfer folder of the Nextcloud uploads collection,
+// then asks the server to assemble them at the target.
+func (u *WebDAVUploader) putChunked(file *os.File, fileInfo os.FileInfo, remotePath string) error {
+	targetURL := u.remoteURL(remotePath)
+	transferURL := fmt.Sprintf("%s/recorder-%d", u.chunkURL, time.Now().UnixNano())
+	totalLength := strconv.FormatInt(fileInfo.Size(), 10)
+	setHeaders := func(req *http.Request) {
+		req.Header.Set("Destination", targetURL)
+		req.Header.Set("OC-Total-Length", totalLength)
+	}
+
+	req, err := u.newRequest("MKCOL", transferURL, nil)
+	if err != nil {
+		return err
+	}
+	setHeaders(req)
+	if err := u.do(req, http.StatusCreated); err != nil {
+		return fmt.Errorf("creating upload folder: %w", err)
+	}
+
+	chunkCount := (fileInfo.Size() + u.chunkSize - 1) / u.chunkSize
+	for chunk := int64(0); chunk < chunkCount; chunk++ {
+		offset := chunk * u.chunkSize
+		length := min(u.chunkSize, fileInfo.Size()-offset)
+		chunkURL := fmt.Sprintf("%s/%05d", transferURL, chunk+1)
+		if err := u.put(chunkURL, io.NewSectionReader(file, offset, length), length, setHeaders); err != nil {
+			u.deleteTransfer(transferURL)
+			return fmt.Errorf("chunk %d/%d: %w", chunk+1, chunkCount, err)
+		}
+	}
+
+	req, err = u.newRequest("MOVE", transferURL+"/.file", nil)
+	if err != nil {
+		return err
+	}
+	setHeaders(req)
+	req.Header.Set("X-OC-Mtime", strconv.FormatInt(fileInfo.ModTime().Unix(), 10))
+	if err := u.do(req, http.StatusCreated, http.StatusNoContent); err != nil {
+		u.deleteTransfer(transferURL)
+		return fmt.Errorf("assembling chunks: %w", err)
+	}
+	return nil
+}
+
+func (u *WebDAVUploader) deleteTransfer(transferURL string) {
+	req, err := u.newRequest(http.MethodDelete, transferURL, nil)
+	if err == nil {
+		err = u.do(req, http.StatusNoContent, http.StatusOK)
+	}
+	if err != nil {
+		log.Printf("Failed to remove upload folder %s: %v", transferURL, err)
+	}
+}
+
+type propfindResponse struct {
+	ContentLength []string `xml:"response>propstat>prop>getcontentlength"`
+}
+
+// size returns the size of the remote file, as reported by PROPFIND.
+func (u *WebDAVUploader) size(remotePath string) (int64, error) {
+	body := strings.NewReader(`<?xml version="1.0"?><d:propfind xmlns:d="DAV:"><d:prop><d:getcontentlength/></d:prop></d:propfind>`)
+	req, err := u.newRequest("PROPFIND", u.remoteURL(remotePath), body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return 0, fmt.Errorf("PROPFIND returned %s", resp.Status)
+	}
+
+	var result propfindResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	for _, contentLength := range result.ContentLength {
+		if contentLength != "" {
+			return strconv.ParseInt(strings.TrimSpace(contentLength), 10, 64)
+		}
+	}
+	return 0, errors.New("PROPFIND returned no content length")
+}
+
+func (u *WebDAVUploader) Fetch(remotePath string) (io.ReadCloser, error) {
+	req, err := u.newRequest(http.MethodGet, u.remoteURL(remotePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET returned %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (u *WebDAVUploader) newRequest(method, targetURL string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, targetURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if u.username != "" || u.password != "" {
+		req.SetBasicAuth(u.username, u.password)
+	}
+	return req, nil
+}
+
+// do sends the request and fails unless the response has one of the expected status codes.
+func (u *WebDAVUploader) do(req *http.Request, expected ...int) error {
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			io.Copy(io.Discard, resp.Body)
+			return nil
+		}
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(detail)))
+}
+
+func (u *WebDAVUploader) DeletesAfterUpload() bool {
+	return u.deleteAfterUpload
+}
@@ -0,0 +1,204 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+
+	appconfig "github.com/jzhang046/croned-twitcasting-recorder-mp4/config"
+)
+
+const (
+	testWebDAVUser     = "recorder"
+	testWebDAVPassword = "secret"
+)
+
+// newWebDAVServer serves an in-memory WebDAV tree behind basic auth. It also assembles Nextcloud-style
+// chunked uploads: a MOVE of "<transfer folder>/.file" concatenates the chunks into its Destination.
+func newWebDAVServer(t *testing.T) (*httptest.Server, webdav.FileSystem) {
+	t.Helper()
+	fs := webdav.NewMemFS()
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != testWebDAVUser || password != testWebDAVPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "MOVE" && strings.HasSuffix(r.URL.Path, "/.file") {
+			assembleChunks(t, fs, w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, fs
+}
+
+func assembleChunks(t *testing.T, fs webdav.FileSystem, w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	transfer := path.Dir(r.URL.Path)
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir, err := fs.OpenFile(ctx, transfer, os.O_RDONLY, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	chunks, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Name() < chunks[j].Name() })
+
+	var assembled bytes.Buffer
+	for _, chunk := range chunks {
+		assembled.Write(readWebDAVFile(t, fs, path.Join(transfer, chunk.Name())))
+	}
+	if total := r.Header.Get("OC-Total-Length"); total != "" && total != strconv.Itoa(assembled.Len()) {
+		http.Error(w, "total length mismatch", http.StatusBadRequest)
+		return
+	}
+
+	target, err := fs.OpenFile(ctx, destination.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	target.Write(assembled.Bytes())
+	target.Close()
+	fs.RemoveAll(ctx, transfer)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func readWebDAVFile(t *testing.T, fs webdav.FileSystem, name string) []byte {
+	t.Helper()
+	file, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("opening %s on the server: %v", name, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("reading %s on the server: %v", name, err)
+	}
+	return data
+}
+
+func writeTestFile(t *testing.T, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	filePath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath, data
+}
+
+func newTestWebDAVUploader(t *testing.T, cfg *appconfig.WebDAVConfig) *WebDAVUploader {
+	t.Helper()
+	cfg.Enabled = true
+	if cfg.Username == "" {
+		cfg.Username, cfg.Password = testWebDAVUser, testWebDAVPassword
+	}
+	u, err := NewWebDAVUploader(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestWebDAVUploadCreatesFolders(t *testing.T) {
+	server, fs := newWebDAVServer(t)
+	u := newTestWebDAVUploader(t, &appconfig.WebDAVConfig{URL: server.URL + "/recordings"})
+	if err := fs.Mkdir(context.Background(), "/recordings", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	filePath, data := writeTestFile(t, "20260101-1200-title.mp4", 64<<10)
+	remotePath := "azusa_shirokyan/2026/01/20260101-1200 title.mp4"
+	if err := u.Upload(filePath, remotePath, Metadata{}); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	if got := readWebDAVFile(t, fs, "/recordings/"+remotePath); !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file has %d bytes, want the %d bytes of the source", len(got), len(data))
+	}
+
+	// A second upload into the same folders must not fail on the existing collections.
+	u.createdDirs = make(map[string]bool)
+	if err := u.Upload(filePath, "azusa_shirokyan/2026/01/other.mp4", Metadata{}); err != nil {
+		t.Fatalf("Upload into existing folders: %v", err)
+	}
+
+	fetched, err := u.Fetch(remotePath)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	defer fetched.Close()
+	if got, _ := io.ReadAll(fetched); !bytes.Equal(got, data) {
+		t.Fatal("fetched file does not match the source")
+	}
+}
+
+func TestWebDAVUploadChunked(t *testing.T) {
+	server, fs := newWebDAVServer(t)
+	for _, dir := range []string{"/files", "/uploads"} {
+		if err := fs.Mkdir(context.Background(), dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := newTestWebDAVUploader(t, &appconfig.WebDAVConfig{
+		URL:         server.URL + "/files",
+		ChunkURL:    server.URL + "/uploads",
+		ChunkSizeMB: 1,
+	})
+	u.chunkSize = 100 << 10
+
+	filePath, data := writeTestFile(t, "capture.ts", 350<<10)
+	if err := u.Upload(filePath, "streamer/capture.ts", Metadata{}); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if got := readWebDAVFile(t, fs, "/files/streamer/capture.ts"); !bytes.Equal(got, data) {
+		t.Fatalf("assembled file has %d bytes, want the %d bytes of the source", len(got), len(data))
+	}
+
+	uploads, err := fs.OpenFile(context.Background(), "/uploads", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uploads.Close()
+	if left, _ := uploads.Readdir(-1); len(left) != 0 {
+		t.Fatalf("%d transfer folder(s) left behind", len(left))
+	}
+}
+
+func TestWebDAVUploadRejectedCredentials(t *testing.T) {
+	server, _ := newWebDAVServer(t)
+	u := newTestWebDAVUploader(t, &appconfig.WebDAVConfig{URL: server.URL, Username: "recorder", Password: "wrong"})
+
+	filePath, _ := writeTestFile(t, "capture.ts", 1024)
+	if err := u.Upload(filePath, "streamer/capture.ts", Metadata{}); err == nil {
+		t.Fatal("Upload succeeded with wrong credentials")
+	}
+}